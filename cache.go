@@ -0,0 +1,150 @@
+package utcode
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// structInfo is what the Encoder and the Decoder compute by reflection
+// about a struct type, it's cached since it never changes
+type structInfo struct {
+	// fields are the fields to encode in declaration order, and sorted
+	// by their keys, for Encoder.SortFields
+	fields, sorted []wireField
+
+	// invalid reports why the struct can't be encoded, like two fields
+	// sharing a key
+	invalid error
+
+	// byName maps the wire names to the fields to decode
+	byName map[string]*reflect.StructField
+
+	// defaults are the values set by the decoder to the fields absent from
+	// the dict, given by the default tag option, or the error parsing them
+	defaults    []fieldDefault
+	defaultsErr error
+}
+
+// fieldDefault is the default value of the field at index
+type fieldDefault struct {
+	index []int
+	value reflect.Value
+}
+
+// wireField is a struct field to encode, under its wire name. The index
+// has more than one element for the fields of inline structs.
+type wireField struct {
+	name   string
+	opts   tagOptions
+	index  []int
+	tagged bool
+}
+
+var (
+	structCache sync.Map // map[reflect.Type]*structInfo
+)
+
+// cachedStruct returns the structInfo of the struct type t
+func cachedStruct(t reflect.Type) *structInfo {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+
+	info, _ := structCache.LoadOrStore(t, newStructInfo(t))
+	return info.(*structInfo)
+}
+
+// RegisterStruct computes upfront what the Encoder and the Decoder need to
+// know about the type of sample, a struct or a pointer to a struct, instead
+// of on its first use. It's safe for concurrent use.
+func RegisterStruct(sample interface{}) {
+	t := reflect.TypeOf(sample)
+	st := t
+	if st != nil && st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+
+	if st == nil || st.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("utcode: cannot register %v, it's not a struct", t))
+	}
+	cachedStruct(st)
+}
+
+func newStructInfo(t reflect.Type) *structInfo {
+	info := &structInfo{
+		byName: make(map[string]*reflect.StructField),
+	}
+
+	seen := make(map[string]string)
+	add := func(name string, opts tagOptions, field reflect.StructField) {
+		if other, ok := seen[name]; ok && info.invalid == nil {
+			info.invalid = fmt.Errorf("ambiguous key %q in %v: fields %v and %v", name, t, other, field.Name)
+		}
+		seen[name] = field.Name
+		info.fields = append(info.fields, wireField{name, opts, field.Index, isTagged(field)})
+
+		// a tagged field wins over an untagged one with the same wire name
+		if prev, ok := info.byName[name]; ok && hasTagName(*prev) && !hasTagName(field) {
+			return
+		}
+		info.byName[name] = &field
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name, opts := fieldName(field)
+		if opts.Contains("inline") {
+			info.inline(t, field, add)
+			continue
+		}
+		add(name, opts, field)
+
+		if text, ok := opts.Value("default"); ok {
+			value := reflect.New(field.Type)
+			if err := coerce("default", value, text); err != nil && info.defaultsErr == nil {
+				info.defaultsErr = fmt.Errorf("invalid default for %v.%v: %v", t, field.Name, err)
+			}
+			info.defaults = append(info.defaults, fieldDefault{field.Index, value.Elem()})
+		}
+	}
+
+	info.sorted = append([]wireField(nil), info.fields...)
+	sort.Slice(info.sorted, func(i, j int) bool { return info.sorted[i].name < info.sorted[j].name })
+	return info
+}
+
+// inline adds the fields of the struct field tagged inline to the ones of
+// its parent t, as if they were declared there, along with their defaults
+func (info *structInfo) inline(t reflect.Type, field reflect.StructField, add func(string, tagOptions, reflect.StructField)) {
+	if field.Type.Kind() != reflect.Struct {
+		if info.invalid == nil {
+			info.invalid = fmt.Errorf("inline field %v of %v is not a struct", field.Name, t)
+		}
+		return
+	}
+
+	inner := cachedStruct(field.Type)
+	if inner.invalid != nil && info.invalid == nil {
+		info.invalid = inner.invalid
+	}
+	if inner.defaultsErr != nil && info.defaultsErr == nil {
+		info.defaultsErr = inner.defaultsErr
+	}
+
+	for _, wf := range inner.fields {
+		f := field.Type.FieldByIndex(wf.index)
+		f.Index = append(append([]int(nil), field.Index...), wf.index...)
+		add(wf.name, wf.opts, f)
+	}
+
+	for _, def := range inner.defaults {
+		index := append(append([]int(nil), field.Index...), def.index...)
+		info.defaults = append(info.defaults, fieldDefault{index, def.value})
+	}
+}
@@ -0,0 +1,45 @@
+package utcode
+
+import (
+	"reflect"
+	"testing"
+)
+
+type Order struct {
+	ID    int `utcode:"id"`
+	Items []Product
+	Notes string
+}
+
+func TestRegisterStruct(t *testing.T) {
+	orderType := reflect.TypeOf(Order{})
+	if _, ok := structCache.Load(orderType); ok {
+		t.Fatal("expected Order not to be cached before its registration")
+	}
+
+	val := Order{ID: 7, Items: []Product{{Name: "pan", Image: &ProductImage{}}}}
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// drop what the encoding cached, for the registration to compute it again
+	structCache.Delete(orderType)
+	RegisterStruct(&Order{})
+
+	info, ok := structCache.Load(orderType)
+	if !ok {
+		t.Fatal("expected Order to be cached after its registration")
+	}
+	if field := info.(*structInfo).byName["id"]; field == nil || field.Name != "ID" {
+		t.Fatalf("expected id to map to the ID field, got %v", field)
+	}
+
+	res := Order{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(val, res) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+}
@@ -0,0 +1,155 @@
+package utcode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// ToJSON translates the UTCode document to JSON, through its interface{}
+// representation. Raw and unicode strings both become JSON strings, and
+// dicts are written with their keys sorted.
+func ToJSON(utcode []byte) ([]byte, error) {
+	var v interface{}
+	if err := Decode(utcode, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// FromJSON translates the JSON document to UTCode, through its interface{}
+// representation. JSON numbers which are integers in the int64 range become
+// ints, the others become floats, which are still written as ints when
+// they're integral (e.g. 2.0), like the Encoder always does.
+func FromJSON(jsonData []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	v, err := fromJSONNumbers(v)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(v)
+}
+
+// fromJSONNumbers replaces the json.Numbers in v with ints or floats
+func fromJSONNumbers(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		for k, elem := range v {
+			if v[k], err = fromJSONNumbers(elem); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, elem := range v {
+			if v[i], err = fromJSONNumbers(elem); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// TranscodeJSONToUTCode translates the stream of JSON values read from r to
+// a stream of UTCode documents written to w, separated by newlines. It works
+// token by token, so the values are never held in memory as a whole, and
+// follows the same rules as FromJSON.
+func TranscodeJSONToUTCode(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	// the open objects and arrays, an object expecting a key is keyNext
+	type frame struct{ object, keyNext bool }
+	var frames []frame
+
+	// valueDone moves past a value, after which an object expects a key
+	valueDone := func() {
+		if n := len(frames); n > 0 && frames[n-1].object {
+			frames[n-1].keyNext = true
+		}
+	}
+
+	var e Encoder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && len(frames) == 0 {
+			break
+		} else if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		if len(frames) == 0 {
+			if e.Len() > 0 {
+				e.WriteString("\n")
+			}
+			e.WriteString("ut:")
+		}
+
+		switch tok := tok.(type) {
+		case json.Delim:
+			switch tok {
+			case '{':
+				e.WriteString("d:")
+				frames = append(frames, frame{object: true, keyNext: true})
+			case '[':
+				e.WriteString("l:")
+				frames = append(frames, frame{})
+			default:
+				e.WriteString("e")
+				frames = frames[:len(frames)-1]
+				valueDone()
+			}
+		case string:
+			if n := len(frames); n > 0 && frames[n-1].keyNext {
+				e.writeKey(tok)
+				frames[n-1].keyNext = false
+			} else {
+				e.writeUnicodeString(tok)
+				valueDone()
+			}
+		case json.Number:
+			if i, err := strconv.ParseInt(string(tok), 10, 64); err == nil {
+				e.writeInt(i)
+			} else if f, err := tok.Float64(); err == nil {
+				floatEncoder(&e, reflect.ValueOf(f))
+			} else {
+				return err
+			}
+			valueDone()
+		case bool:
+			boolEncoder(&e, reflect.ValueOf(tok))
+			valueDone()
+		case nil:
+			e.WriteString("n:e")
+			valueDone()
+		default:
+			return fmt.Errorf("unexpected JSON token %v", tok)
+		}
+
+		if e.Len() >= 32<<10 {
+			if _, err := e.WriteTo(w); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := e.WriteTo(w)
+	return err
+}
@@ -0,0 +1,85 @@
+package utcode
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	docs := []string{
+		`{"a":[1,-2,3.5,"x",true,null],"b":{"c":{"d":[]},"e":{}},"f":"héllo"}`,
+		`[9007199254740993,1e+100,0.1]`,
+		`"plain"`,
+		`null`,
+	}
+
+	for _, doc := range docs {
+		data, err := FromJSON([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := ToJSON(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res) != doc {
+			t.Errorf("expected %s, got %s (through %s)", doc, res, data)
+		}
+	}
+
+	// integral floats can't be told apart from ints
+	data, err := FromJSON([]byte(`[2.0]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ut:l:i:2ee" {
+		t.Fatalf("expected an int, got %s", data)
+	}
+
+	if res, err := ToJSON([]byte("ut:d:k1:as2:hie")); err != nil || string(res) != `{"a":"hi"}` {
+		t.Fatalf("expected a raw string to become a JSON string, got %s, %v", res, err)
+	}
+}
+
+func TestTranscodeJSONToUTCode(t *testing.T) {
+	// a large nested document, followed by a second one in the stream
+	var doc bytes.Buffer
+	doc.WriteString(`{"items":[`)
+	for i := 0; i < 5000; i++ {
+		if i > 0 {
+			doc.WriteString(",")
+		}
+		fmt.Fprintf(&doc, `{"id":%d,"name":"item %d","price":%d.5,"tags":["a","b"],"meta":{"ok":true,"none":null}}`, i, i, i)
+	}
+	doc.WriteString(`],"count":5000}`)
+	first := doc.String()
+	doc.WriteString("\n[1, \"two\", 3.25]")
+
+	var out bytes.Buffer
+	if err := TranscodeJSONToUTCode(&doc, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := bytes.Split(out.Bytes(), []byte("\n"))
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 documents, got %d", len(docs))
+	}
+
+	for i, src := range []string{first, `[1,"two",3.25]`} {
+		expected, err := FromJSON([]byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if equal, err := Equal(docs[i], expected); err != nil || !equal {
+			t.Fatalf("expected document %d to match FromJSON, %v", i, err)
+		}
+	}
+
+	if err := TranscodeJSONToUTCode(strings.NewReader(`{"a":[1,}`), &out); err == nil {
+		t.Fatal("expected an error transcoding invalid JSON")
+	}
+}
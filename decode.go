@@ -1,12 +1,20 @@
 package utcode
 
 import (
+	"database/sql"
+	"encoding"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
-	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unsafe"
 )
 
 // Decode will decode the UTCode data using the default Decoder
@@ -15,98 +23,534 @@ func Decode(data []byte, v interface{}) error {
 	return d.Decode(data, v)
 }
 
+// DecodeString will decode the UTCode string using the default Decoder,
+// reading from the string without copying it
+func DecodeString(s string, v interface{}) error {
+	var d Decoder
+	return d.DecodeString(s, v)
+}
+
+// DecodeTo will decode the UTCode data into a new value of type T using
+// the default Decoder, sparing the caller the pointer
+func DecodeTo[T any](data []byte) (T, error) {
+	var v T
+	err := Decode(data, &v)
+	return v, err
+}
+
+// Peek returns the type code of the top-level value in the UTCode data
+// ('n', 'b', 'i', 'f', 's', 'u', 'd', 'l' or 'c') without decoding it
+func Peek(data []byte) (byte, error) {
+	if len(data) < 3 || string(data[:3]) != "ut:" {
+		return 0, NewDecodeError("invalid utcode")
+	}
+
+	if len(data) == 3 {
+		return 0, NewDecodeError("empty document")
+	}
+
+	return data[3], nil
+}
+
 type Decoder struct {
-	data   []byte
+	data   string
 	off    int
-	custom map[string]typeDecoder
+	custom map[byte]typeDecoder
+	types  map[reflect.Type]func(d *Decoder, v reflect.Value) error
+
+	// src frames the documents read by a Decoder from NewReaderDecoder
+	src *Tokenizer
+
+	// borrowed is set while data is read in place from the []byte given to
+	// Decode, the strings read from it are then copied
+	borrowed bool
+
+	// docs counts the documents decoded from the stream
+	docs int
+
+	// interned holds the strings decoded so far, see InternStrings
+	interned map[string]string
+
+	// NoHeader expects the data to start right at the type code,
+	// without the "ut:" header, as written by Encoder.OmitHeader
+	NoHeader bool
+
+	// UseJSONUnmarshaler decodes strings into the types implementing
+	// json.Unmarshaler through their UnmarshalJSON method, to read what
+	// was written by Encoder.UseJSONMarshaler
+	UseJSONUnmarshaler bool
+
+	// Trace, when set, is called for every token read. It's meant as
+	// a debugging aid for complex payloads.
+	Trace func(event TraceEvent)
+
+	// NumberKind selects the types of the numbers decoded into interfaces
+	NumberKind NumberKind
+
+	// DisallowDuplicateKeys fails the decoding when a key repeats within
+	// a dict, instead of letting the last value win
+	DisallowDuplicateKeys bool
+
+	// CoerceScalars decodes numbers and bools into string fields as their
+	// textual form, and strings holding a number or a bool into fields
+	// of those kinds, for lenient interop. Floats are truncated into int
+	// fields. Decoding is strict otherwise.
+	CoerceScalars bool
+
+	// MaxElements limits the number of elements of every list and dict,
+	// guarding against documents crafted to exhaust the memory. It's
+	// unlimited when zero.
+	MaxElements int
+
+	// InternStrings makes the equal strings decoded, map keys included,
+	// share their memory, which saves it for large documents repeating
+	// strings like enum values. The strings are kept by the Decoder across
+	// documents until Reset.
+	InternStrings bool
+
+	// RequireTag decodes only into the struct fields with a tag, skipping
+	// the keys of the others, like Encoder.RequireTag
+	RequireTag bool
+
+	// ReuseSlices decodes the lists into the backing arrays of the
+	// destination slices, up to their capacity, instead of decoding into
+	// their elements and appending the others. The reused elements are
+	// reset first, which saves allocations when decoding repeatedly into
+	// the same slice.
+	ReuseSlices bool
+
+	// Unflatten turns the dotted keys of the top-level dicts written by
+	// Encoder.Flatten back into nested dicts before decoding them
+	Unflatten bool
+
+	// MaxDocuments limits the number of documents decoded from a stream,
+	// guarding against streams which never end. It's unlimited when zero.
+	MaxDocuments int
+
+	// Base64Encoding is the alphabet of the unicode strings, it must match
+	// the Encoder.Base64Encoding of the producer. The standard one, padded
+	// or not, is used when nil.
+	Base64Encoding *base64.Encoding
+
+	// AllowEmpty decodes an empty document, with or without the header,
+	// like "ut:n:e" instead of failing: pointers, interfaces, maps and
+	// slices are set to nil and other values are left untouched
+	AllowEmpty bool
 }
 
-func NewDecoder() *Decoder {
-	return &Decoder{
-		custom: make(map[string]typeDecoder),
+// NewDecoder returns a Decoder configured with the given options
+func NewDecoder(opts ...DecoderOption) *Decoder {
+	d := &Decoder{
+		custom: make(map[byte]typeDecoder),
+	}
+	for _, opt := range opts {
+		opt(d)
 	}
+	return d
 }
 
-func (d *Decoder) Decode(data []byte, v interface{}) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if _, ok := r.(runtime.Error); ok {
-				panic(r)
-			}
-			if s, ok := r.(string); ok {
-				panic(s)
-			}
-			err = r.(error)
-		}
-	}()
+// Register a custom type decoder for the values keyed as 'c' followed by
+// the given type code. Custom values live under their own prefix, so they
+// never shadow the built-in types, and a decoder registered here takes
+// precedence over a package-level one for the same code.
+func (d *Decoder) Register(prefix byte, decoder typeDecoder) {
+	if d.custom == nil {
+		d.custom = make(map[byte]typeDecoder)
+	}
+	d.custom[prefix] = decoder
+}
+
+// RegisterType registers a function decoding the values whose destination
+// is of type t, whatever their wire type. It's given the settable destination
+// and reads the value through DecodeValue, e.g. to parse a string into a
+// domain type. It takes precedence over every other way of decoding t,
+// including the Unmarshaler and Scanner interfaces.
+func (d *Decoder) RegisterType(t reflect.Type, fn func(d *Decoder, v reflect.Value) error) {
+	if d.types == nil {
+		d.types = make(map[reflect.Type]func(d *Decoder, v reflect.Value) error)
+	}
+	d.types[t] = fn
+}
+
+// DecodeValue decodes the next value into v, which must be a non-nil
+// pointer or map. It's meant for the functions given to RegisterType.
+func (d *Decoder) DecodeValue(v interface{}) error {
+	return d.decodeValue(reflect.ValueOf(v))
+}
 
-	value := reflect.ValueOf(v)
+var (
+	customDecoders = make(map[byte]typeDecoder)
+)
+
+// RegisterDecoder registers a custom type decoder for every Decoder,
+// including the one used by Decode. It is not safe for concurrent use
+// and should be called during initialization.
+func RegisterDecoder(prefix byte, decoder typeDecoder) {
+	customDecoders[prefix] = decoder
+}
+
+// Decode decodes the UTCode data. Unlike DecodeString, the decoded strings
+// are copied out of data, so that data isn't retained by them.
+func (d *Decoder) Decode(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return d.DecodeString("", v)
+	}
+
+	d.borrowed = true
+	err := d.DecodeString(unsafe.String(&data[0], len(data)), v)
+	d.borrowed = false
+
+	// what's left of data may still be decoded by DecodeNext
+	d.data, d.off = strings.Clone(d.data[d.off:]), 0
+	return err
+}
 
-	d.data = data
+// DecodeString decodes the UTCode string, decoded strings share their memory with s
+func (d *Decoder) DecodeString(s string, v interface{}) error {
+	d.data = s
 	d.off = 0
+	return d.decodeDocument(v)
+}
+
+// NumberKind selects the dynamic types of the numbers decoded into interfaces
+type NumberKind int
+
+const (
+	// NumberDefault decodes ints as int and floats as float64
+	NumberDefault NumberKind = iota
+
+	// Number32 decodes the ints fitting in 32 bits as int32 and the floats
+	// surviving the conversion to float32 unchanged as float32, which halves
+	// the memory they take in large documents. The other numbers still decode
+	// as int and float64, so a consumer must handle both types. Since integral
+	// floats are encoded as ints, they come back as int32 too.
+	Number32
+)
 
-	if d.read(3) != "ut:" {
-		panic(NewDecodeError("invalid utcode"))
+// decodeDocument decodes the document starting at the current offset
+func (d *Decoder) decodeDocument(v interface{}) error {
+	if err := d.readHeader(); err != nil {
+		return err
 	}
 
-	if (value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface) && value.IsNil() {
-		value.Elem().Set(d.decodeTypeAndCreate())
-	} else if value.IsNil() {
-		value.Set(d.decodeTypeAndCreate())
-	} else {
-		d.decodeType(value)
+	if d.off >= len(d.data) {
+		if d.AllowEmpty {
+			setNil(reflect.ValueOf(v))
+			return nil
+		}
+		return NewDecodeError("empty document")
+	}
+
+	if d.Unflatten {
+		return d.decodeUnflattened(v)
+	}
+	return d.decodeValue(reflect.ValueOf(v))
+}
+
+func (d *Decoder) readHeader() error {
+	if d.NoHeader {
+		return nil
+	}
+
+	if d.off >= len(d.data) {
+		if d.AllowEmpty {
+			return nil
+		}
+		return NewDecodeError("missing utcode header")
+	}
+
+	if header, err := d.read(3); err != nil || header != "ut:" {
+		return NewDecodeError("invalid utcode")
 	}
 	return nil
 }
 
-func (d *Decoder) decodeType(v reflect.Value) {
+// decodeValue decodes the next value into the destination given by the user,
+// which must be a non-nil pointer or map
+func (d *Decoder) decodeValue(value reflect.Value) error {
+	switch {
+	case value.Kind() == reflect.Ptr && !value.IsNil():
+		if value.Type().Elem() == interfaceType && value.Elem().IsNil() {
+			val, err := d.decodeTypeAndCreate()
+			if err == nil && val.IsValid() {
+				value.Elem().Set(val.Elem())
+			}
+			return err
+		}
+		return d.decodeType(value)
+	case value.Kind() == reflect.Map && !value.IsNil():
+		return d.decodeType(value)
+	case !value.IsValid():
+		return NewDecodeError("cannot decode into nil")
+	default:
+		return NewDecodeError(fmt.Sprintf("cannot decode into %v, it must be a non-nil pointer or map", value.Type()))
+	}
+}
+
+func (d *Decoder) decodeType(v reflect.Value) error {
 	if d.off >= len(d.data) {
-		return
+		return NewDecodeError("unexpected end of utcode")
 	}
 
-	key, ok := d.readUntil(':')
-	if !ok {
-		panic(NewDecodeError("invalid utcode"))
+	if len(d.types) > 0 && v.Kind() == reflect.Ptr && !v.IsNil() {
+		if fn, ok := d.types[v.Type().Elem()]; ok {
+			return fn(d, v.Elem())
+		}
+	}
+
+	if d.UseJSONUnmarshaler && v.Kind() == reflect.Ptr && !v.IsNil() && hasMethods(v.Type(), jsonUnmarshalerType) {
+		return jsonDecoder(d, v)
+	}
+
+	if isScanner(v) {
+		return scannerDecoder(d, v)
+	}
+
+	if v.Kind() == reflect.Ptr && v.Type().Elem() == errorType {
+		return errorDecoder(d, v)
+	}
+
+	if v.Kind() == reflect.Ptr && v.Type().Elem() == durationType && (d.peek() == 'u' || d.peek() == 's') {
+		return durationDecoder(d, v)
+	}
+
+	if v.Kind() == reflect.Ptr && (d.peek() == 'u' || d.peek() == 's') {
+		if names, ok := enums[v.Type().Elem()]; ok {
+			return enumDecoder(d, names, v)
+		}
+	}
+
+	if v.Kind() == reflect.Ptr && !v.IsNil() && hasMethods(v.Type(), textUnmarshalerType) {
+		return textDecoder(d, v)
+	}
+
+	if v.Kind() == reflect.Ptr && !v.IsNil() && hasMethods(v.Type(), binaryUnmarshalerType) {
+		return binaryDecoder(d, v)
+	}
+
+	// a nil value sets pointer destinations to nil, others are
+	// allocated as needed and decoded into
+	if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Ptr {
+		if d.peek() == 'n' {
+			v.Elem().Set(reflect.Zero(v.Elem().Type()))
+			return d.skipValue()
+		}
+
+		if v.Elem().IsNil() {
+			v.Elem().Set(reflect.New(v.Elem().Type().Elem()))
+		}
+		return d.decodeType(v.Elem())
+	}
+
+	key, err := d.readTypeKey()
+	if err != nil {
+		return err
 	}
-	d.read(1)
 
 	decoder := d.typeDecoder(key)
 	if decoder == nil {
-		panic(NewDecodeError(fmt.Sprintf("invalid utcode type '%s'", d.peek())))
+		return NewDecodeError(fmt.Sprintf("invalid utcode type '%c'", key[0]))
 	}
 
-	decoder(d, key, v)
+	return decoder(d, key, v)
 }
 
-func (d *Decoder) decodeTypeAndCreate() reflect.Value {
+func (d *Decoder) decodeTypeAndCreate() (reflect.Value, error) {
 	if d.off >= len(d.data) {
-		return reflect.ValueOf(nil)
+		return reflect.Value{}, NewDecodeError("unexpected end of utcode")
 	}
 
-	key, ok := d.readUntil(':')
-	if !ok {
-		panic(NewDecodeError("invalid utcode"))
+	key, err := d.readTypeKey()
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	if key[0] == 'd' {
+		if val, ok, err := d.decodeNamed(); ok || err != nil {
+			return val, err
+		}
 	}
-	d.read(1)
 
 	decoder, zeroValue := d.typeDecoderAndCreate(key)
 	if decoder == nil {
-		panic(NewDecodeError(fmt.Sprintf("invalid utcode type '%s'", d.peek())))
+		return reflect.Value{}, NewDecodeError(fmt.Sprintf("invalid utcode type '%c'", key[0]))
 	}
 
 	val := reflect.ValueOf(zeroValue)
-	decoder(d, key, val)
-	return val
+	if err := decoder(d, key, val); err != nil {
+		return reflect.Value{}, err
+	}
+
+	if d.NumberKind == Number32 && (key[0] == 'i' || key[0] == 'f') {
+		val = narrowNumber(val)
+	}
+	return val, nil
+}
+
+// narrowNumber returns the created number as a pointer to its 32 bits
+// type, when it fits without loss
+func narrowNumber(v reflect.Value) reflect.Value {
+	switch n := v.Elem().Interface().(type) {
+	case int:
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			i := int32(n)
+			return reflect.ValueOf(&i)
+		}
+	case float64:
+		if f := float32(n); float64(f) == n {
+			return reflect.ValueOf(&f)
+		}
+	}
+	return v
+}
+
+// readTypeKey reads the key of the next value, up to and including the ':'
+func (d *Decoder) readTypeKey() (string, error) {
+	off := d.off
+	key, ok := d.readUntil(':')
+	if !ok {
+		return "", NewDecodeError("invalid utcode")
+	}
+	d.off++
+	d.trace(TraceValue, off, key[0], "")
+
+	// the keys of custom values are handed to their decoders, which may keep them
+	if key[0] == 'c' {
+		key = d.own(key)
+	}
+	return key, nil
+}
+
+// skipValue consumes the next value without decoding it
+func (d *Decoder) skipValue() error {
+	key, err := d.readTypeKey()
+	if err != nil {
+		return err
+	}
+
+	switch key[0] {
+	case 'n', 'b':
+		_, err = d.read(1)
+	case 'i':
+		if _, ok := d.readUntil('e'); !ok {
+			return NewDecodeError("could not find int end")
+		}
+		d.off++
+	case 'f':
+		if _, ok := d.readUntil('z'); !ok {
+			return NewDecodeError("could not find float end")
+		}
+		d.off++
+	case 's', 'u':
+		var length int
+		if length, err = parseInt(key[1:]); err == nil {
+			_, err = d.read(length)
+		}
+	case 'd':
+		for err == nil && d.peek() != 'e' {
+			if _, err = dictKey(d); err == nil {
+				err = d.skipValue()
+			}
+		}
+		if err == nil {
+			err = d.readEnd()
+		}
+	case 'l':
+		for err == nil && d.peek() != 'e' {
+			err = d.skipValue()
+		}
+		if err == nil {
+			err = d.readEnd()
+		}
+	case 'c':
+		var val interface{}
+		err = customDecoder(d, key, reflect.ValueOf(&val))
+	default:
+		err = NewDecodeError(fmt.Sprintf("invalid utcode type '%c'", key[0]))
+	}
+	return err
+}
+
+// countEntries counts the entries of the dict or list starting at the
+// current offset without consuming them, so its map or slice can be
+// allocated with the right size upfront. Malformed entries are left
+// for the actual decoding to report. The counting stops at the first
+// nested container, since skipping it would scan its subtree once for
+// every level of nesting above it.
+func (d *Decoder) countEntries(dict bool) int {
+	off, trace := d.off, d.Trace
+	d.Trace = nil
+	defer func() {
+		d.off, d.Trace = off, trace
+	}()
+
+	n := 0
+	for d.off < len(d.data) && d.peek() != 'e' {
+		if dict {
+			if _, err := dictKey(d); err != nil {
+				break
+			}
+		}
+		if c := d.peek(); c == 'd' || c == 'l' || c == 'c' {
+			break
+		}
+		if err := d.skipValue(); err != nil {
+			break
+		}
+		n++
+
+		// the decoding fails past the limit, no need to count further
+		if d.MaxElements > 0 && n > d.MaxElements {
+			break
+		}
+	}
+	return n
+}
+
+// checkElements fails when the n-th element of a container exceeds
+// Decoder.MaxElements
+func (d *Decoder) checkElements(n int) error {
+	if d.MaxElements > 0 && n > d.MaxElements {
+		return NewDecodeError(fmt.Sprintf("too many elements, the limit is %d", d.MaxElements))
+	}
+	return nil
 }
 
+// peek returns the next byte without consuming it, or 0 at the end of the data
 func (d *Decoder) peek() byte {
+	if d.off >= len(d.data) {
+		return 0
+	}
 	return d.data[d.off]
 }
 
-func (d *Decoder) read(n int) string {
+// readEnd consumes the terminator of a dict or a list
+func (d *Decoder) readEnd() error {
+	if d.peek() != 'e' {
+		return NewDecodeError("unexpected end of utcode")
+	}
+
+	d.trace(TraceEnd, d.off, 0, "")
+	d.off++
+	return nil
+}
+
+func (d *Decoder) read(n int) (string, error) {
+	if n < 0 || n > len(d.data)-d.off {
+		return "", NewDecodeError("unexpected end of utcode")
+	}
+
 	i := d.off
-	str := string(d.data[i : i+n])
+	str := d.data[i : i+n]
 	d.off += n
+	return d.own(str), nil
+}
+
+// own returns str, copied when it's borrowed from the data given to Decode
+func (d *Decoder) own(str string) string {
+	if d.borrowed {
+		return strings.Clone(str)
+	}
 	return str
 }
 
@@ -124,7 +568,9 @@ func (d *Decoder) readUntil(ch byte) (string, bool) {
 		return "", false
 	}
 
-	return d.read(count), true
+	str := d.data[d.off : d.off+count]
+	d.off += count
+	return str, true
 }
 
 func (d *Decoder) typeDecoder(key string) typeDecoder {
@@ -146,7 +592,6 @@ func (d *Decoder) typeDecoder(key string) typeDecoder {
 	case 'l':
 		return listDecoder
 	case 'c':
-		// TODO: will custom be prefixed with 'c'?
 		return customDecoder
 	default:
 		return nil
@@ -173,12 +618,14 @@ func (d *Decoder) typeDecoderAndCreate(key string) (typeDecoder, interface{}) {
 		val := ""
 		return unicodeDecoder, &val
 	case 'd':
-		return dictDecoder, &map[string]interface{}{}
+		val := make(map[string]interface{}, d.countEntries(true))
+		return dictDecoder, &val
 	case 'l':
-		return listDecoder, &[]interface{}{}
+		val := make([]interface{}, 0, d.countEntries(false))
+		return listDecoder, &val
 	case 'c':
-		panic(NewDecodeError("custom type must be top-level"))
-		fallthrough
+		var val interface{}
+		return customDecoder, &val
 	default:
 		return nil, nil
 	}
@@ -186,6 +633,7 @@ func (d *Decoder) typeDecoderAndCreate(key string) (typeDecoder, interface{}) {
 
 type DecodeError struct {
 	what string
+	err  error
 }
 
 func NewDecodeError(what string) *DecodeError {
@@ -194,253 +642,1065 @@ func NewDecodeError(what string) *DecodeError {
 	}
 }
 
+// wrapDecodeError returns a DecodeError caused by err, like a strconv
+// or base64 error, which can be reached with errors.Is and errors.As
+func wrapDecodeError(what string, err error) *DecodeError {
+	return &DecodeError{
+		what: what,
+		err:  err,
+	}
+}
+
 func (d *DecodeError) Error() string {
+	if d.err != nil {
+		return d.what + ": " + d.err.Error()
+	}
 	return d.what
 }
 
-type typeDecoder func(d *Decoder, key string, v reflect.Value)
-
-func nilDecoder(d *Decoder, key string, v reflect.Value) {
-	d.read(1)
+// Unwrap returns the underlying error, if any
+func (d *DecodeError) Unwrap() error {
+	return d.err
 }
 
-func boolDecoder(d *Decoder, key string, v reflect.Value) {
-	v.Elem().SetBool(!(d.peek() == '0'))
-	d.read(1)
+// TypeError reports a value which can't be decoded into the destination
+// type, like a list into a struct
+type TypeError struct {
+	Value string       // the wire type of the value, e.g. "list" or "integer 300"
+	Type  reflect.Type // the destination type
 }
 
-func intDecoder(d *Decoder, key string, v reflect.Value) {
-	str, ok := d.readUntil('e')
-	if !ok {
-		panic(NewDecodeError("could not find int end"))
+func (e *TypeError) Error() string {
+	if e.Type.PkgPath() != "" {
+		return fmt.Sprintf("cannot decode %s into %v %v", e.Value, e.Type.Kind(), e.Type.Name())
 	}
-
-	v.Elem().SetInt(int64(parseInt(str)))
-	d.read(1)
+	return fmt.Sprintf("cannot decode %s into %v", e.Value, e.Type)
 }
 
-func floatDecoder(d *Decoder, key string, v reflect.Value) {
-	str, ok := d.readUntil('z')
-	if !ok {
-		panic(NewDecodeError("could not find float end"))
-	}
+type typeDecoder func(d *Decoder, key string, v reflect.Value) error
 
-	if f, err := strconv.ParseFloat(str, 64); err != nil {
-		panic(err)
-	} else {
-		v.Elem().SetFloat(f)
+// wireTypeName names the wire type of the given type code for the errors
+func wireTypeName(code byte) string {
+	switch code {
+	case 'n':
+		return "nil"
+	case 'b':
+		return "bool"
+	case 'i':
+		return "integer"
+	case 'f':
+		return "float"
+	case 's', 'u':
+		return "string"
+	case 'd':
+		return "dictionary"
+	case 'l':
+		return "list"
+	case 'c':
+		return "custom value"
+	default:
+		return fmt.Sprintf("unknown type '%c'", code)
 	}
-	d.read(1)
 }
 
-func stringDecoder(d *Decoder, key string, v reflect.Value) {
-	length := parseInt(key[1:])
-	v.Elem().SetString(d.read(length))
+// mismatchError reports a wire value which can't be decoded into the destination
+func mismatchError(what string, v reflect.Value) error {
+	return &TypeError{what, v.Type().Elem()}
 }
 
-func unicodeDecoder(d *Decoder, key string, v reflect.Value) {
-	length := parseInt(key[1:])
-	data, err := base64.StdEncoding.DecodeString(d.read(length))
-	if err != nil {
-		panic(err)
-	}
-
-	v.Elem().SetString(string(data))
+// overflowError reports an int out of the range of the destination kind
+func overflowError(i int, v reflect.Value) error {
+	return &TypeError{fmt.Sprintf("%s %d", wireTypeName('i'), i), v.Type().Elem()}
 }
 
-func dictDecoder(d *Decoder, key string, v reflect.Value) {
-	mapValue := v
-	if v.Type().Kind() != reflect.Struct && v.IsNil() {
-		mapValue = reflect.ValueOf(map[string]interface{}{})
+func nilDecoder(d *Decoder, key string, v reflect.Value) error {
+	_, err := d.read(1)
+	if err == nil {
+		setNil(v)
 	}
+	return err
+}
 
-	switch mapValue.Type().Kind() {
-	case reflect.Ptr, reflect.Interface:
-		dictDecoder(d, key, mapValue.Elem())
+// setNil resets the pointer, interface, map or slice pointed by v to nil,
+// leaving the values of other kinds as they are, like encoding/json does
+func setNil(v reflect.Value) {
+	if v.Kind() != reflect.Ptr || v.IsNil() {
 		return
-	case reflect.Map:
-		fillMap(d, mapValue.Interface().(map[string]interface{}))
-	case reflect.Struct:
-		fillStruct(d, mapValue)
 	}
 
-	if v.Type().Kind() != reflect.Struct && v.IsNil() {
-		v.Set(mapValue)
+	switch elem := v.Elem(); elem.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if elem.CanSet() {
+			elem.Set(reflect.Zero(elem.Type()))
+		}
 	}
-
-	d.read(1)
 }
 
-func listDecoder(d *Decoder, key string, v reflect.Value) {
-	if !isValidList(v) {
-		return
+func boolDecoder(d *Decoder, key string, v reflect.Value) error {
+	str, err := d.read(1)
+	if err != nil {
+		return err
 	}
 
-	sliceValue := v
-	if v.Elem().IsNil() {
-		sliceValue = reflect.ValueOf(&[]interface{}{})
+	b, err := parseBool(str[0])
+	if err != nil {
+		return err
 	}
+	switch v.Elem().Kind() {
+	case reflect.Bool:
+		v.Elem().SetBool(b)
+	case reflect.Interface:
+		return setInterface(v, reflect.ValueOf(b))
+	default:
+		if !d.CoerceScalars {
+			return mismatchError(wireTypeName('b'), v)
+		}
 
-	if elemType := sliceValue.Type().Elem(); elemType.Kind() == reflect.Struct {
-		fillStructSlice(d, sliceValue, elemType)
-	} else {
-		fillSlice(d, sliceValue)
+		// numbers take a bool as 1 or 0, the way ints are coerced into bools
+		text := strconv.FormatBool(b)
+		if v.Elem().Kind() != reflect.String && b {
+			text = "1"
+		} else if v.Elem().Kind() != reflect.String {
+			text = "0"
+		}
+		return coerce(wireTypeName('b'), v, text)
 	}
+	return nil
+}
 
-	if v.Elem().IsNil() {
-		v.Elem().Set(sliceValue)
+func intDecoder(d *Decoder, key string, v reflect.Value) error {
+	str, ok := d.readUntil('e')
+	if !ok {
+		return NewDecodeError("could not find int end")
 	}
+	d.off++
 
-	d.read(1)
-}
-
-func customDecoder(d *Decoder, key string, v reflect.Value) {
-	// TODO: custom decoding
-}
+	i, err := parseInt(str)
+	if err != nil {
+		return err
+	}
 
-func acceptNil(v reflect.Kind) bool {
-	return false
+	// integral floats are encoded as ints too
+	switch v.Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Elem().OverflowInt(int64(i)) {
+			return overflowError(i, v)
+		}
+		v.Elem().SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i < 0 || v.Elem().OverflowUint(uint64(i)) {
+			return overflowError(i, v)
+		}
+		v.Elem().SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		v.Elem().SetFloat(float64(i))
+	case reflect.Interface:
+		return setInterface(v, reflect.ValueOf(i))
+	default:
+		if d.CoerceScalars {
+			return coerce(wireTypeName('i'), v, strconv.Itoa(i))
+		}
+		return mismatchError(wireTypeName('i'), v)
+	}
+	return nil
 }
 
-func dictKey(d *Decoder) (string, bool) {
-	key, ok := d.readUntil(':')
+func floatDecoder(d *Decoder, key string, v reflect.Value) error {
+	str, ok := d.readUntil('z')
 	if !ok {
-		return "", false
+		return NewDecodeError("could not find float end")
 	}
+	d.off++
 
-	if key[0] != 'k' {
-		return "", false
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return wrapDecodeError("invalid float", err)
 	}
-	d.read(1)
-
-	length := parseInt(key[1:])
-	return d.read(length), true
-}
 
-func fillMap(d *Decoder, out map[string]interface{}) {
-	for {
-		if d.peek() == 'e' {
-			break
+	switch v.Elem().Kind() {
+	case reflect.Float32, reflect.Float64:
+		v.Elem().SetFloat(f)
+	case reflect.Interface:
+		return setInterface(v, reflect.ValueOf(f))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !d.CoerceScalars {
+			return mismatchError(wireTypeName('f'), v)
 		}
 
-		key, ok := dictKey(d)
-		if !ok {
-			break
+		// floats are truncated into ints, failing when out of their range
+		whole := math.Trunc(f)
+		if whole == 0 {
+			whole = 0 // drops the sign of -0
 		}
-
-		val := d.decodeTypeAndCreate()
-		if val.IsValid() {
-			out[key] = val.Elem().Interface()
-		} else {
-			out[key] = nil
+		return coerce(wireTypeName('f'), v, strconv.FormatFloat(whole, 'f', -1, 64))
+	default:
+		if d.CoerceScalars {
+			return coerce(wireTypeName('f'), v, strconv.FormatFloat(f, 'g', -1, 64))
 		}
+		return mismatchError(wireTypeName('f'), v)
 	}
+	return nil
 }
 
-func fillStruct(d *Decoder, v reflect.Value) {
-	fields := structFieldsMap(v.Type())
-	for {
-		if d.peek() == 'e' {
-			break
-		}
-
-		key, ok := dictKey(d)
-		if !ok {
-			break
-		}
+func stringDecoder(d *Decoder, key string, v reflect.Value) error {
+	length, err := parseInt(key[1:])
+	if err != nil {
+		return err
+	}
 
-		field, ok := fields[key]
-		if !ok {
-			continue
-		}
+	str, err := d.read(length)
+	if err != nil {
+		return err
+	}
 
-		setStructField(d, field, v)
+	if w, ok := stringSink(v); ok {
+		return copyToSink(w, strings.NewReader(str), length)
 	}
+
+	return d.setString(v, str)
 }
 
-func parseInt(str string) int {
-	if i, err := strconv.ParseInt(str, 0, 64); err != nil {
-		panic(err)
-		return 0
-	} else {
-		return int(i)
+func unicodeDecoder(d *Decoder, key string, v reflect.Value) error {
+	length, err := parseInt(key[1:])
+	if err != nil {
+		return err
 	}
-}
 
-func setStructField(d *Decoder, f *reflect.StructField, v reflect.Value) {
-	kind := f.Type.Kind()
-	switch kind {
+	str, err := d.read(length)
+	if err != nil {
+		return err
+	}
+
+	enc := base64Encoding(d.Base64Encoding, length)
+	if w, ok := stringSink(v); ok {
+		return copyToSink(w, base64.NewDecoder(enc, strings.NewReader(str)), length)
+	}
+
+	data, err := enc.DecodeString(str)
+	if err != nil {
+		return wrapDecodeError("invalid unicode string", err)
+	}
+
+	return d.setString(v, string(data))
+}
+
+func (d *Decoder) setString(v reflect.Value, str string) error {
+	switch v.Elem().Kind() {
+	case reflect.String:
+		v.Elem().SetString(d.intern(str))
+	case reflect.Slice:
+		switch v.Elem().Type().Elem().Kind() {
+		case reflect.Uint8:
+			v.Elem().SetBytes([]byte(str))
+		case reflect.Int32:
+			// set one by one, the element type may be a named rune type
+			runes := []rune(str)
+			slice := reflect.MakeSlice(v.Elem().Type(), len(runes), len(runes))
+			for i, r := range runes {
+				slice.Index(i).SetInt(int64(r))
+			}
+			v.Elem().Set(slice)
+		default:
+			return mismatchError(wireTypeName('s'), v)
+		}
+	case reflect.Array:
+		if v.Elem().Type().Elem().Kind() != reflect.Uint8 {
+			return mismatchError(wireTypeName('s'), v)
+		}
+		if len(str) != v.Elem().Len() {
+			return NewDecodeError(fmt.Sprintf("cannot decode %d bytes into %v", len(str), v.Elem().Type()))
+		}
+		reflect.Copy(v.Elem(), reflect.ValueOf(str))
+	case reflect.Interface:
+		return setInterface(v, reflect.ValueOf(d.intern(str)))
+	default:
+		if d.CoerceScalars {
+			return coerce(wireTypeName('s'), v, str)
+		}
+		return mismatchError(wireTypeName('s'), v)
+	}
+	return nil
+}
+
+// intern returns the first equal string seen when InternStrings is set
+func (d *Decoder) intern(str string) string {
+	if !d.InternStrings {
+		return str
+	}
+
+	if s, ok := d.interned[str]; ok {
+		return s
+	}
+	if d.interned == nil {
+		d.interned = make(map[string]string)
+	}
+	d.interned[str] = str
+	return str
+}
+
+// coerce stores the textual form of a scalar into a destination of another
+// scalar kind, see Decoder.CoerceScalars
+func coerce(what string, v reflect.Value, text string) error {
+	var err error
+	switch elem := v.Elem(); elem.Kind() {
+	case reflect.String:
+		elem.SetString(text)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(text); err == nil {
+			elem.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(text, 10, elem.Type().Bits()); err == nil {
+			elem.SetInt(i)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		if u, err = strconv.ParseUint(text, 10, elem.Type().Bits()); err == nil {
+			elem.SetUint(u)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(text, elem.Type().Bits()); err == nil {
+			elem.SetFloat(f)
+		}
+	default:
+		return mismatchError(what, v)
+	}
+
+	if err != nil {
+		return wrapDecodeError(fmt.Sprintf("cannot coerce %s %q into %v", what, text, v.Type().Elem()), err)
+	}
+	return nil
+}
+
+// setInterface stores the decoded value in the interface pointed by v
+func setInterface(v reflect.Value, val reflect.Value) error {
+	if !val.Type().AssignableTo(v.Type().Elem()) {
+		return mismatchError(val.Type().String(), v)
+	}
+
+	v.Elem().Set(val)
+	return nil
+}
+
+// base64Encoding returns the custom encoding if any, otherwise the padded
+// encoding written by the Encoder, or the raw one when the length shows the
+// producer left out the padding
+func base64Encoding(custom *base64.Encoding, length int) *base64.Encoding {
+	if custom != nil {
+		return custom
+	}
+
+	if length%4 != 0 {
+		return base64.RawStdEncoding
+	}
+	return base64.StdEncoding
+}
+
+var (
+	writerType    = reflect.TypeOf((*io.Writer)(nil)).Elem()
+	interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// stringSink returns the writer a decoded string should be streamed into,
+// when the destination is an io.Writer (e.g. *bytes.Buffer) instead of a string
+func stringSink(v reflect.Value) (io.Writer, bool) {
+	if v.Kind() != reflect.Ptr || v.IsNil() || !v.Type().Implements(writerType) {
+		return nil, false
+	}
+	return v.Interface().(io.Writer), true
+}
+
+// copyToSink writes the string read from r into the sink w in chunks, so a
+// large string is never held decoded as a whole. The length of the encoded
+// string bounds the chunks.
+func copyToSink(w io.Writer, r io.Reader, length int) error {
+	if length > sinkChunkSize {
+		length = sinkChunkSize
+	} else if length < 512 {
+		length = 512
+	}
+
+	buf := make([]byte, length)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return wrapDecodeError("cannot write the string", err)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return wrapDecodeError("invalid unicode string", err)
+		}
+	}
+}
+
+// sinkChunkSize is the size of the chunks written by copyToSink
+const sinkChunkSize = 32 << 10
+
+var (
+	scannerType           = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	jsonUnmarshalerType   = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+func isScanner(v reflect.Value) bool {
+	return v.Kind() == reflect.Ptr && !v.IsNil() && hasMethods(v.Type(), scannerType)
+}
+
+// scannerDecoder decodes the next value generically and hands it to the
+// destination's Scan method, converting ints to the int64 a sql.Scanner expects
+func scannerDecoder(d *Decoder, v reflect.Value) error {
+	val, err := d.decodeTypeAndCreate()
+	if err != nil {
+		return err
+	}
+
+	var src interface{}
+	if val.IsValid() {
+		src = val.Elem().Interface()
+	}
+
+	switch n := src.(type) {
+	case int:
+		src = int64(n)
+	case int32:
+		src = int64(n)
+	case float32:
+		src = float64(n)
+	}
+
+	scanner := v.Interface().(sql.Scanner)
+	err = scanner.Scan(src)
+
+	// a time.Time driver.Value is encoded as its text, which the scanners
+	// of times like sql.NullTime don't take
+	if str, ok := src.(string); ok && err != nil {
+		if t, terr := time.Parse(time.RFC3339Nano, str); terr == nil {
+			err = scanner.Scan(t)
+		}
+	}
+	return err
+}
+
+// decodeString decodes the next value, which must be a string or nil
+func (d *Decoder) decodeString(v reflect.Value) (string, bool, error) {
+	val, err := d.decodeTypeAndCreate()
+	if err != nil || !val.IsValid() {
+		return "", false, err
+	}
+
+	str, ok := val.Elem().Interface().(string)
+	if !ok {
+		return "", false, mismatchError(val.Elem().Kind().String(), v)
+	}
+	return str, true, nil
+}
+
+// errorDecoder rebuilds an error from its message, only the message
+// survives the round-trip
+func errorDecoder(d *Decoder, v reflect.Value) error {
+	msg, ok, err := d.decodeString(v)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		v.Elem().Set(reflect.Zero(errorType))
+		return nil
+	}
+
+	v.Elem().Set(reflect.ValueOf(errors.New(msg)))
+	return nil
+}
+
+// textDecoder hands the decoded string to the destination's UnmarshalText
+// method, a nil value leaves the destination untouched
+func textDecoder(d *Decoder, v reflect.Value) error {
+	text, ok, err := d.decodeString(v)
+	if err != nil || !ok {
+		return err
+	}
+
+	return v.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+}
+
+// binaryDecoder hands the decoded string to the destination's UnmarshalBinary
+// method, for the types without text support (e.g. url.URL)
+func binaryDecoder(d *Decoder, v reflect.Value) error {
+	data, ok, err := d.decodeString(v)
+	if err != nil || !ok {
+		return err
+	}
+
+	return v.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary([]byte(data))
+}
+
+// jsonDecoder hands the JSON held in the decoded string to the
+// destination's UnmarshalJSON method
+func jsonDecoder(d *Decoder, v reflect.Value) error {
+	data, ok, err := d.decodeString(v)
+	if err != nil || !ok {
+		return err
+	}
+
+	return v.Interface().(json.Unmarshaler).UnmarshalJSON([]byte(data))
+}
+
+// durationDecoder parses a time.Duration written in its String form
+func durationDecoder(d *Decoder, v reflect.Value) error {
+	str, _, err := d.decodeString(v)
+	if err != nil {
+		return err
+	}
+
+	dur, err := time.ParseDuration(str)
+	if err != nil {
+		return wrapDecodeError("invalid duration", err)
+	}
+	v.Elem().SetInt(int64(dur))
+	return nil
+}
+
+func dictDecoder(d *Decoder, key string, v reflect.Value) error {
+	var err error
+	switch v.Kind() {
 	case reflect.Ptr:
-		new := reflect.New(f.Type.Elem())
-		d.decodeType(new)
-		v.FieldByName(f.Name).Set(new)
+		if v.IsNil() {
+			if !v.CanSet() {
+				return NewDecodeError(fmt.Sprintf("cannot decode dict into nil %v", v.Type()))
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return dictDecoder(d, key, v.Elem())
 	case reflect.Interface:
-		val := d.decodeTypeAndCreate()
-		v.FieldByName(f.Name).Set(val.Elem())
+		if !v.IsNil() {
+			return dictDecoder(d, key, v.Elem())
+		}
+		if v.NumMethod() != 0 {
+			return d.decodeNamedInto(v)
+		}
+
+		m := make(map[string]interface{}, d.countEntries(true))
+		err = fillMap(d, m)
+		v.Set(reflect.ValueOf(m))
+	case reflect.Map:
+		if !isMapKeyType(v.Type().Key()) {
+			return &TypeError{wireTypeName('d'), v.Type()}
+		}
+		if v.Type() != mapType {
+			if v.IsNil() {
+				v.Set(reflect.MakeMapWithSize(v.Type(), d.countEntries(true)))
+			}
+			err = fillTypedMap(d, v)
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.ValueOf(make(map[string]interface{}, d.countEntries(true))))
+		}
+		err = fillMap(d, v.Interface().(map[string]interface{}))
+	case reflect.Struct:
+		if !v.CanSet() {
+			return NewDecodeError(fmt.Sprintf("cannot decode dict into unaddressable %v", v.Type()))
+		}
+		err = fillStruct(d, v)
+	default:
+		return &TypeError{wireTypeName('d'), v.Type()}
+	}
+
+	if err != nil {
+		return err
+	}
+	return d.readEnd()
+}
+
+var (
+	mapType = reflect.TypeOf(map[string]interface{}{})
+)
+
+func listDecoder(d *Decoder, key string, v reflect.Value) error {
+	if !isValidList(v) {
+		return &TypeError{wireTypeName('l'), v.Type()}
+	}
+
+	switch elem := v.Elem(); elem.Kind() {
+	case reflect.Ptr:
+		if elem.IsNil() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		return listDecoder(d, key, elem)
+	case reflect.Interface:
+		return listInterfaceDecoder(d, key, elem)
+	case reflect.Array:
+		if err := fillArray(d, elem); err != nil {
+			return err
+		}
+		return d.readEnd()
+	case reflect.Complex64, reflect.Complex128:
+		return complexDecoder(d, elem)
+	case reflect.Slice:
+	default:
+		return &TypeError{wireTypeName('l'), elem.Type()}
+	}
+
+	if v.Elem().IsNil() {
+		v.Elem().Set(reflect.MakeSlice(v.Elem().Type(), 0, 0))
+	}
+
+	if err := fillSlice(d, v); err != nil {
+		return err
+	}
+	return d.readEnd()
+}
+
+// complexDecoder decodes the real and imaginary parts of a complex number
+func complexDecoder(d *Decoder, v reflect.Value) error {
+	var parts [2]float64
+	for i := range parts {
+		if d.peek() == 'e' {
+			return NewDecodeError(fmt.Sprintf("expected 2 parts for %v", v.Type()))
+		}
+		if err := d.decodeType(reflect.ValueOf(&parts[i])); err != nil {
+			return err
+		}
+	}
+
+	if d.peek() != 'e' {
+		return NewDecodeError(fmt.Sprintf("expected 2 parts for %v", v.Type()))
+	}
+
+	v.SetComplex(complex(parts[0], parts[1]))
+	return d.readEnd()
+}
+
+// listInterfaceDecoder decodes a list into an interface, reusing the slice
+// (or pointer to one) it holds, otherwise filling it with a []interface{}
+func listInterfaceDecoder(d *Decoder, key string, v reflect.Value) error {
+	if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+		return listDecoder(d, key, v.Elem())
+	}
+
+	var slice reflect.Value
+	if !v.IsNil() && v.Elem().Kind() == reflect.Slice {
+		slice = reflect.New(v.Elem().Type())
+		slice.Elem().Set(v.Elem())
+	} else if v.NumMethod() == 0 {
+		slice = reflect.ValueOf(&[]interface{}{})
+	} else {
+		return &TypeError{wireTypeName('l'), v.Type()}
+	}
+
+	if err := listDecoder(d, key, slice); err != nil {
+		return err
+	}
+	v.Set(slice.Elem())
+	return nil
+}
+
+// customDecoder dispatches a custom value to its registered decoder.
+// Custom values are keyed as 'c' followed by the custom type code, and
+// whatever else the key holds is left for the custom decoder to interpret.
+// When the destination is created by the decoder, v is a *interface{}.
+func customDecoder(d *Decoder, key string, v reflect.Value) error {
+	if len(key) < 2 {
+		return NewDecodeError("missing custom type code")
+	}
+
+	decoder, ok := d.custom[key[1]]
+	if !ok {
+		decoder, ok = customDecoders[key[1]]
+	}
+	if !ok {
+		return NewDecodeError(fmt.Sprintf("unregistered custom type '%c'", key[1]))
+	}
+
+	return decoder(d, key, v)
+}
+
+func dictKey(d *Decoder) (string, error) {
+	off := d.off
+	key, ok := d.readUntil(':')
+	if !ok || key[0] != 'k' {
+		return "", NewDecodeError("invalid dict key")
+	}
+	d.off++
+
+	length, err := parseInt(key[1:])
+	if err != nil {
+		return "", err
+	}
+
+	key, err = d.read(length)
+	if err != nil {
+		return "", err
+	}
+
+	d.trace(TraceKey, off, 0, key)
+	return key, nil
+}
+
+// keySet tracks the keys of a dict, it's nil unless duplicates are disallowed
+type keySet map[string]struct{}
+
+func (d *Decoder) keySet() keySet {
+	if !d.DisallowDuplicateKeys {
+		return nil
+	}
+	return make(keySet)
+}
+
+func (s keySet) add(key string) error {
+	if s == nil {
+		return nil
+	}
+
+	if _, ok := s[key]; ok {
+		return NewDecodeError(fmt.Sprintf("duplicate dict key %q", key))
+	}
+	s[key] = struct{}{}
+	return nil
+}
+
+func fillMap(d *Decoder, out map[string]interface{}) error {
+	seen := d.keySet()
+	for n := 1; d.peek() != 'e'; n++ {
+		if err := d.checkElements(n); err != nil {
+			return err
+		}
+
+		key, err := dictKey(d)
+		if err != nil {
+			return err
+		}
+
+		if err := seen.add(key); err != nil {
+			return err
+		}
+
+		val, err := d.decodeTypeAndCreate()
+		if err != nil {
+			return err
+		}
+
+		if val.IsValid() {
+			out[d.intern(key)] = val.Elem().Interface()
+		} else {
+			out[d.intern(key)] = nil
+		}
+	}
+	return nil
+}
+
+// fillTypedMap fills a map with string or registered keys and values of
+// any type other than interface{}, see fillMap
+func fillTypedMap(d *Decoder, v reflect.Value) error {
+	t := v.Type()
+	seen := d.keySet()
+	for n := 1; d.peek() != 'e'; n++ {
+		if err := d.checkElements(n); err != nil {
+			return err
+		}
+
+		key, err := dictKey(d)
+		if err != nil {
+			return err
+		}
+
+		if err := seen.add(key); err != nil {
+			return err
+		}
+
+		k, err := d.mapKey(t.Key(), key)
+		if err != nil {
+			return err
+		}
+
+		elem := reflect.New(t.Elem())
+		if err := d.decodeType(elem); err != nil {
+			return err
+		}
+		v.SetMapIndex(k, elem.Elem())
+	}
+	return nil
+}
+
+// mapKey decodes a map key of type t from its dict key, see RegisterMapKey
+func (d *Decoder) mapKey(t reflect.Type, key string) (reflect.Value, error) {
+	if t.Kind() == reflect.String {
+		return reflect.ValueOf(d.intern(key)).Convert(t), nil
+	}
+
+	// the key is decoded in place of the document, which is restored after
+	data, off := d.data, d.off
+	d.data, d.off = key, 0
+
+	k := reflect.New(t)
+	err := d.decodeType(k)
+	if err == nil && d.off != len(key) {
+		err = NewDecodeError(fmt.Sprintf("invalid %v key %q", t, key))
+	}
+
+	d.data, d.off = data, off
+	return k.Elem(), err
+}
+
+func fillStruct(d *Decoder, v reflect.Value) error {
+	info := cachedStruct(v.Type())
+	if info.defaultsErr != nil {
+		return info.defaultsErr
+	}
+
+	// the defaults of the fields set, to give the others theirs
+	var set []bool
+	if len(info.defaults) > 0 {
+		set = make([]bool, len(info.defaults))
+	}
+
+	seen := d.keySet()
+	for n := 1; d.peek() != 'e'; n++ {
+		if err := d.checkElements(n); err != nil {
+			return err
+		}
+
+		key, err := dictKey(d)
+		if err != nil {
+			return err
+		}
+
+		if err := seen.add(key); err != nil {
+			return err
+		}
+
+		field, ok := lookupField(v.Type(), info, key)
+		if ok && d.RequireTag && !isTagged(*field) {
+			ok = false
+		}
+
+		if !ok {
+			err = d.skipValue()
+		} else {
+			err = setStructField(d, field, v)
+			for i, def := range info.defaults {
+				if slices.Equal(def.index, field.Index) {
+					set[i] = true
+				}
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, def := range info.defaults {
+		if !set[i] {
+			v.FieldByIndex(def.index).Set(def.value)
+		}
+	}
+	return nil
+}
+
+// lookupField finds the struct field for the dict key. An exact tag name wins,
+// then the exact wire name of an untagged field, then the exact Go field name
+// and lastly a case-insensitive match, in declaration order (like encoding/json)
+func lookupField(t reflect.Type, info *structInfo, key string) (*reflect.StructField, bool) {
+	if field, ok := info.byName[key]; ok {
+		return field, true
+	}
+
+	// promoted fields aren't encoded at the top level, hence the index check
+	if field, ok := t.FieldByName(key); ok && field.PkgPath == "" && len(field.Index) == 1 {
+		return &field, true
+	}
+
+	for _, wf := range info.fields {
+		if strings.EqualFold(wf.name, key) {
+			field := t.FieldByIndex(wf.index)
+			field.Index = wf.index
+			return &field, true
+		}
+	}
+	return nil, false
+}
+
+// parseBool parses the bool written as b:1 or b:0, or as b:t or b:f by
+// Encoder.BoolLetters and other implementations
+func parseBool(c byte) (bool, error) {
+	switch c {
+	case '1', 't':
+		return true, nil
+	case '0', 'f':
+		return false, nil
 	default:
-		d.decodeType(v.FieldByName(f.Name).Addr())
+		return false, NewDecodeError(fmt.Sprintf("invalid bool '%c'", c))
 	}
 }
 
-func structFieldsMap(t reflect.Type) map[string]*reflect.StructField {
-	res := make(map[string]*reflect.StructField)
+// parseInt parses the ints of i:<int>e values and the lengths of strings and
+// keys. Their grammar is [+-]?[0-9]+ within 64 bits: an optional sign and
+// decimal digits, without whitespace, underscores or base prefixes, and
+// leading zeros don't make it octal. Implementations should write no sign
+// for positive numbers.
+func parseInt(str string) (int, error) {
+	i, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, wrapDecodeError("invalid number", err)
+	}
+	return int(i), nil
+}
+
+func setStructField(d *Decoder, f *reflect.StructField, v reflect.Value) error {
+	kind := f.Type.Kind()
+	switch kind {
+	case reflect.Interface:
+		if f.Type == errorType {
+			return d.decodeType(v.FieldByIndex(f.Index).Addr())
+		}
 
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		if field.PkgPath != "" {
-			continue
+		val, err := d.decodeTypeAndCreate()
+		if err != nil {
+			return err
 		}
 
-		name, tag := field.Name, field.Tag.Get(TagName)
-		if tag == "" {
-			name = strings.ToLower(name[:1]) + name[1:]
+		field := v.FieldByIndex(f.Index)
+		if !val.IsValid() {
+			field.Set(reflect.Zero(f.Type))
+		} else if val.Elem().Type().AssignableTo(f.Type) {
+			field.Set(val.Elem())
 		} else {
-			name = tag
+			return interfaceFieldError(f, val.Elem().Type())
 		}
+	default:
+		return d.decodeType(v.FieldByIndex(f.Index).Addr())
+	}
+	return nil
+}
 
-		res[name] = &field
+// interfaceFieldError reports a value which doesn't satisfy the interface of
+// the field. There's no concrete type to allocate for an interface (embedded
+// ones included), so the value must name its type, see RegisterName.
+func interfaceFieldError(f *reflect.StructField, t reflect.Type) error {
+	what := "field"
+	if f.Anonymous {
+		what = "embedded field"
 	}
-	return res
+	return NewDecodeError(fmt.Sprintf("cannot decode %v into %s %s of interface type %v, its concrete type must be registered with RegisterName and encoded with Encoder.TypeNames", t, what, f.Name, f.Type))
 }
 
 func isValidList(v reflect.Value) bool {
 	switch v.Type().Kind() {
 	case reflect.Ptr:
-		return true
+		return !v.IsNil()
 	default:
 		return false
 	}
 }
 
-func fillSlice(d *Decoder, v reflect.Value) {
-	length := v.Elem().Len()
+func fillSlice(d *Decoder, v reflect.Value) error {
+	slice := v.Elem()
+	length := slice.Len()
 	i := 0
 
 	for d.peek() != 'e' {
-		if i >= length {
-			elem := d.decodeTypeAndCreate().Elem()
-			v.Elem().Set(reflect.Append(v.Elem(), elem))
-		} else {
-			d.decodeType(v.Elem().Index(i).Addr())
+		if err := d.checkElements(i + 1); err != nil {
+			return err
 		}
 
+		var err error
+		switch {
+		case d.ReuseSlices && i < slice.Cap():
+			err = d.reuseElem(slice, i)
+		case i >= length:
+			var elem reflect.Value
+			if elem, err = d.decodeElem(slice.Type().Elem()); err == nil {
+				slice.Set(reflect.Append(slice, elem))
+			}
+		default:
+			err = d.decodeType(slice.Index(i).Addr())
+		}
+
+		if err != nil {
+			return err
+		}
 		i++
 	}
+
+	// the elements past the decoded ones are left over from the destination
+	if i < slice.Len() {
+		slice.SetLen(i)
+	}
+	return nil
 }
 
-func fillStructSlice(d *Decoder, v reflect.Value, elemType reflect.Type) {
-	length := v.Len()
+// reuseElem decodes the next value into the element at i of the slice,
+// within its capacity, resetting the element first, see Decoder.ReuseSlices
+func (d *Decoder) reuseElem(slice reflect.Value, i int) error {
+	if slice.Len() <= i {
+		slice.SetLen(i + 1)
+	}
+
+	elem := slice.Index(i)
+	elem.Set(reflect.Zero(elem.Type()))
+	if elem.Kind() != reflect.Interface {
+		return d.decodeType(elem.Addr())
+	}
+
+	val, err := d.decodeElem(elem.Type())
+	if err == nil {
+		elem.Set(val)
+	}
+	return err
+}
+
+// decodeElem decodes the next value as a new element of type t. Interface
+// elements hold whatever the value creates, others are decoded in place.
+func (d *Decoder) decodeElem(t reflect.Type) (reflect.Value, error) {
+	if t.Kind() != reflect.Interface {
+		elem := reflect.New(t)
+		return elem.Elem(), d.decodeType(elem)
+	}
+
+	val, err := d.decodeTypeAndCreate()
+	if err != nil || !val.IsValid() {
+		return reflect.Zero(t), err
+	}
+
+	if !val.Elem().Type().AssignableTo(t) {
+		return reflect.Value{}, NewDecodeError(fmt.Sprintf("cannot decode %v into %v", val.Elem().Type(), t))
+	}
+	return val.Elem(), nil
+}
+
+// fillArray decodes the list elements into the array, the extra ones are
+// discarded and the missing ones are zeroed, like encoding/json does
+func fillArray(d *Decoder, v reflect.Value) error {
 	i := 0
+	for ; d.peek() != 'e'; i++ {
+		if err := d.checkElements(i + 1); err != nil {
+			return err
+		}
 
-	for d.peek() != 'e' {
-		if i >= length {
-			zero := reflect.Zero(elemType)
-			d.decodeType(zero)
-			v.Elem().Set(reflect.Append(v.Elem(), zero))
+		var err error
+		if i < v.Len() {
+			err = d.decodeType(v.Index(i).Addr())
 		} else {
-			d.decodeType(v.Elem().Index(i).Addr())
+			err = d.skipValue()
 		}
 
-		i++
+		if err != nil {
+			return err
+		}
+	}
+
+	for ; i < v.Len(); i++ {
+		v.Index(i).Set(reflect.Zero(v.Type().Elem()))
 	}
+	return nil
 }
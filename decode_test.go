@@ -0,0 +1,1660 @@
+package utcode
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type Attachment struct {
+	Name string
+	Blob *bytes.Buffer
+}
+
+func TestDecodeStringIntoBuffer(t *testing.T) {
+	blob := strings.Repeat("ünïcødé blob ", 10000)
+	data, err := Encode(struct {
+		Name string
+		Blob string
+	}{"big.txt", blob})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &Attachment{}
+	if err := Decode(data, res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Name != "big.txt" {
+		t.Fatalf("expected name %q, got %q", "big.txt", res.Name)
+	}
+	if res.Blob == nil || res.Blob.String() != blob {
+		t.Fatal("blob was not streamed into the buffer")
+	}
+}
+
+type Labels []string
+
+func (l Labels) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *Labels) Scan(src interface{}) error {
+	s, ok := src.(string)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Labels", src)
+	}
+	*l = strings.Split(s, ",")
+	return nil
+}
+
+type Record struct {
+	Labels  Labels
+	Count   sql.NullInt64
+	Note    sql.NullString
+	At      sql.NullTime
+	Done    sql.NullBool
+	Ratio   sql.NullFloat64
+	Total   sql.NullFloat64
+	Missing sql.NullTime
+}
+
+func TestValuerScannerRoundTrip(t *testing.T) {
+	val := Record{
+		Labels: Labels{"red", "green", "blue"},
+		Count:  sql.NullInt64{Int64: 42, Valid: true},
+		At:     sql.NullTime{Time: time.Date(2020, 5, 17, 10, 30, 0, 500, time.UTC), Valid: true},
+		Done:   sql.NullBool{Bool: true, Valid: true},
+		Ratio:  sql.NullFloat64{Float64: 0.25, Valid: true},
+		Total:  sql.NullFloat64{Float64: 3, Valid: true},
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := Record{Note: sql.NullString{String: "stale", Valid: true}}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(val, res) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+}
+
+type Point struct {
+	X, Y int
+}
+
+func pointDecoder(d *Decoder, key string, v reflect.Value) error {
+	var x, y int
+	if err := d.decodeType(reflect.ValueOf(&x)); err != nil {
+		return err
+	}
+	if err := d.decodeType(reflect.ValueOf(&y)); err != nil {
+		return err
+	}
+	v.Elem().Set(reflect.ValueOf(Point{x, y}))
+	return d.readEnd()
+}
+
+func TestDecodeNestedCustom(t *testing.T) {
+	d := NewDecoder()
+	d.Register('p', pointDecoder)
+
+	res := []interface{}{}
+	err := d.Decode([]byte("ut:l:i:1ecp:i:3ei:4eed:k2:atcp:i:5ei:6eeee"), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{
+		1,
+		Point{3, 4},
+		map[string]interface{}{"at": Point{5, 6}},
+	}
+	if !reflect.DeepEqual(expected, res) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	encode := func(v interface{}) []byte {
+		data, err := Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		data     []byte
+		wireType byte
+	}{
+		{encode(nil), 'n'},
+		{encode(true), 'b'},
+		{encode(42), 'i'},
+		{encode(4.2), 'f'},
+		{encode("foo"), 'u'},
+		{[]byte("ut:s3:foo"), 's'},
+		{encode(map[string]int{"a": 1}), 'd'},
+		{encode([]int{1, 2}), 'l'},
+		{[]byte("ut:cp:i:1ei:2ee"), 'c'},
+	}
+
+	for _, test := range tests {
+		wireType, err := Peek(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wireType != test.wireType {
+			t.Errorf("%s: expected '%c', got '%c'", test.data, test.wireType, wireType)
+		}
+	}
+
+	for _, data := range []string{"", "ut", "ut:", "xx:i:1e"} {
+		if _, err := Peek([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestDecodeFieldNameFold(t *testing.T) {
+	res := &Product{}
+	err := Decode([]byte("ut:d:k4:Names5:Shirtk8:QUANTITYi:5ee"), res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Name != "Shirt" || res.Quantity != 5 {
+		t.Fatalf("expected name and quantity to be set, got %v", res)
+	}
+}
+
+type Account struct {
+	Name   string
+	secret string `utcode:"secret"`
+	Active bool
+}
+
+func TestDecodeSkipsUnexportedField(t *testing.T) {
+	res := Account{}
+	err := Decode([]byte("ut:d:k4:names3:bobk6:secretd:k1:al:i:1ef:2.5zeek6:activeb:1e"), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Name != "bob" || res.secret != "" || !res.Active {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestDecodeStructPtrSlice(t *testing.T) {
+	val := []*Product{
+		{Name: "Shirt", Quantity: 5, Image: &ProductImage{Large: "large"}},
+		{Name: "Pants", Quantity: 2, Image: &ProductImage{Small: "small"}},
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res []*Product
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(val, res) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+}
+
+func TestDecodeSliceTruncated(t *testing.T) {
+	res := []int{9, 9, 9, 9, 9}
+	if err := Decode([]byte("ut:l:i:1ei:2ee"), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 2 || !reflect.DeepEqual(res, []int{1, 2}) {
+		t.Fatalf("expected [1 2], got %v", res)
+	}
+
+	if err := Decode([]byte("ut:l:e"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expected no elements, got %v", res)
+	}
+}
+
+func benchmarkPayload(b *testing.B) string {
+	data, err := Encode(Product{
+		Name:        "Shirt",
+		Description: strings.Repeat("black shirt ", 100),
+		Quantity:    5,
+		Image:       &ProductImage{Large: "large", Medium: "medium", Small: "small"},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return string(data)
+}
+
+func BenchmarkDecode(b *testing.B) {
+	s := benchmarkPayload(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		res := Product{}
+		if err := Decode([]byte(s), &res); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeString(b *testing.B) {
+	s := benchmarkPayload(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		res := Product{}
+		if err := DecodeString(s, &res); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeHappyPath(b *testing.B) {
+	val := make([]Product, 50)
+	for i := range val {
+		val[i] = Product{
+			Name:        fmt.Sprintf("product%d", i),
+			Description: "a product in the catalog",
+			Quantity:    i,
+			Image:       &ProductImage{Large: "large", Medium: "medium", Small: "small"},
+		}
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("typed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var res []Product
+			if err := Decode(data, &res); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("interface", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var res interface{}
+			if err := Decode(data, &res); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDecodeCopiesStrings(t *testing.T) {
+	data := []byte("ut:d:k4:names3:pank3:tags4:tailee")
+
+	var res map[string]interface{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	// the strings don't share the memory of data
+	for i := range data {
+		data[i] = 'x'
+	}
+	expected := map[string]interface{}{"name": "pan", "tag": "tail"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	// nor does what's left for DecodeNext
+	d := NewDecoder()
+	data = []byte("ut:s3:foo\nut:s3:bar")
+	var first, second string
+	if err := d.Decode(data, &first); err != nil {
+		t.Fatal(err)
+	}
+	copy(data, "ut:s3:xxx\nut:s3:xxx")
+	if err := d.DecodeNext(&second); err != nil {
+		t.Fatal(err)
+	}
+	if first != "foo" || second != "bar" {
+		t.Fatalf("expected foo and bar, got %q and %q", first, second)
+	}
+}
+
+type Contact struct {
+	Title string `utcode:"name"`
+	Name  string
+	Email string
+}
+
+func TestFieldNamePrecedence(t *testing.T) {
+	res := Contact{}
+	err := Decode([]byte("ut:d:k4:Names3:Bobk4:names2:Drk5:EMAILs7:b@b.come"), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Contact{Title: "Dr", Name: "Bob", Email: "b@b.com"}
+	if res != expected {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	if _, err := Encode(expected); err == nil {
+		t.Fatal("expected an error for the ambiguous key")
+	}
+}
+
+func TestDecodeListIntoInterface(t *testing.T) {
+	data, err := Encode([]interface{}{"foo", 2, []int{3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res interface{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{"foo", 2, []interface{}{3}}
+	if !reflect.DeepEqual(expected, res) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	data, err = Encode([]string{"foo", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var typed interface{} = []string{}
+	if err := Decode(data, &typed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"foo", "bar"}, typed) {
+		t.Fatalf("expected the typed slice to be filled, got %#v", typed)
+	}
+
+	var ptr *[]string
+	if err := Decode(data, &ptr); err != nil {
+		t.Fatal(err)
+	}
+	if ptr == nil || !reflect.DeepEqual([]string{"foo", "bar"}, *ptr) {
+		t.Fatalf("expected the pointer to be allocated and filled, got %v", ptr)
+	}
+}
+
+func TestDecodeNestedIntoInterfaceMap(t *testing.T) {
+	expected := map[string]interface{}{
+		"name": "order",
+		"items": []interface{}{
+			map[string]interface{}{"sku": "a1", "qty": 2, "tags": []interface{}{"new", nil}},
+			map[string]interface{}{"sku": "b2", "price": 9.5, "meta": map[string]interface{}{}},
+			[]interface{}{true, 3},
+		},
+		"shipping": map[string]interface{}{
+			"address": map[string]interface{}{"city": "Porto", "zip": nil},
+			"express": false,
+		},
+	}
+
+	data, err := Encode(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]interface{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, res) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestDecodeUnpaddedUnicode(t *testing.T) {
+	res := ""
+	if err := Decode([]byte("ut:u7:aGVsbG8"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != "hello" {
+		t.Fatalf("expected hello, got %q", res)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Decode([]byte("ut:u7:aGVsbG8"), buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello" {
+		t.Fatalf("expected hello, got %q", buf.String())
+	}
+}
+
+// chunkWriter records the size of the writes, failing past limit bytes
+type chunkWriter struct {
+	writes []int
+	n      int
+	limit  int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	w.n += len(p)
+	if w.n > w.limit {
+		return 0, errors.New("sink full")
+	}
+	return len(p), nil
+}
+
+func TestDecodeStringSink(t *testing.T) {
+	long := strings.Repeat("x", 3*sinkChunkSize)
+	unicode, err := Encode(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte(fmt.Sprintf("ut:s%d:%s", len(long), long))
+
+	for _, data := range [][]byte{raw, unicode} {
+		w := &chunkWriter{limit: len(long)}
+		if err := Decode(data, w); err != nil {
+			t.Fatal(err)
+		}
+		if w.n != len(long) || len(w.writes) < 3 {
+			t.Fatalf("expected the string in chunks, got the writes %v", w.writes)
+		}
+		for _, n := range w.writes {
+			if n > sinkChunkSize {
+				t.Fatalf("expected chunks of at most %d bytes, got %d", sinkChunkSize, n)
+			}
+		}
+
+		// the write errors are decode errors
+		err := Decode(data, &chunkWriter{limit: 10})
+		if _, ok := err.(*DecodeError); !ok || err.Error() != "cannot write the string: sink full" {
+			t.Fatalf("expected a write error, got %#v", err)
+		}
+	}
+
+	err = Decode([]byte("ut:u4:a!!!"), &bytes.Buffer{})
+	if _, ok := err.(*DecodeError); !ok || !strings.HasPrefix(err.Error(), "invalid unicode string") {
+		t.Fatalf("expected an invalid unicode error, got %#v", err)
+	}
+}
+
+func BenchmarkDecodeLargeDict(b *testing.B) {
+	val := make(map[string]int, 10000)
+	for i := 0; i < 10000; i++ {
+		val[fmt.Sprintf("key%d", i)] = i
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var res interface{}
+		if err := Decode(data, &res); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeDeeplyNested(b *testing.B) {
+	const depth = 8000
+	lists := strings.Repeat("l:i:1e", depth) + strings.Repeat("e", depth)
+	dicts := strings.Repeat("d:k1:ai:1ek1:b", depth) + "n:e" + strings.Repeat("e", depth)
+
+	for _, data := range []string{lists, dicts} {
+		b.Run(data[:1], func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var res interface{}
+				if err := DecodeString("ut:"+data, &res); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	inputs := []string{
+		"ut:",
+		"ut:i:12",
+		"ut:s5:abc",
+		"ut:d:k1:ai:1e",
+		"ut:l:i:1e",
+		"ut:x:1",
+		"ut:cz:e",
+		"ut:u9223372036854775807:abc",
+		"ut:s9223372036854775807:abc",
+		"ut:d:k9223372036854775807:abce",
+	}
+
+	for _, in := range inputs {
+		var res interface{}
+		if err := Decode([]byte(in), &res); err == nil {
+			t.Fatalf("expected an error decoding %q", in)
+		}
+	}
+
+	var s string
+	if err := Decode([]byte("ut:i:1e"), &s); err == nil {
+		t.Fatal("expected an error decoding an int into a string")
+	}
+
+	var i int
+	if err := Decode([]byte("ut:i:1e"), i); err == nil {
+		t.Fatal("expected an error decoding into a non-pointer")
+	}
+}
+
+func TestDecodeNumberKind(t *testing.T) {
+	data, err := Encode(map[string]interface{}{
+		"small": 12,
+		"big":   int64(1) << 40,
+		"half":  0.5,
+		"pi":    3.141592653589793,
+		"list":  []int{1, 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder()
+	d.NumberKind = Number32
+
+	var res map[string]interface{}
+	if err := d.Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"small": int32(12),
+		"big":   1 << 40,
+		"half":  float32(0.5),
+		"pi":    3.141592653589793,
+		"list":  []interface{}{int32(1), int32(2)},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, res)
+	}
+
+	var list []int
+	if err := d.Decode([]byte("ut:l:i:1ei:2ee"), &list); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []int{1, 2}) {
+		t.Fatalf("expected [1 2], got %v", list)
+	}
+}
+
+func TestDecodeKeyOrder(t *testing.T) {
+	docs := []string{
+		"ut:d:k4:names3:pank8:quantityi:3ek5:extras1:xe",
+		"ut:d:k5:extrab:1k8:quantityi:3ek4:names3:pane",
+	}
+
+	for _, doc := range docs {
+		res := Product{Description: "stale"}
+		if err := Decode([]byte(doc), &res); err != nil {
+			t.Fatal(err)
+		}
+
+		// keys may come in any order, the missing ones leave their fields untouched
+		expected := Product{Name: "pan", Description: "stale", Quantity: 3}
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatalf("expected %v, got %v", expected, res)
+		}
+	}
+}
+
+func TestDisallowDuplicateKeys(t *testing.T) {
+	data := []byte("ut:d:k4:names3:pank4:names3:pote")
+
+	var m map[string]interface{}
+	if err := Decode(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["name"] != "pot" {
+		t.Fatalf("expected the last value to win, got %v", m["name"])
+	}
+
+	var p Product
+	if err := Decode(data, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "pot" {
+		t.Fatalf("expected the last value to win, got %v", p.Name)
+	}
+
+	d := NewDecoder()
+	d.DisallowDuplicateKeys = true
+	if err := d.Decode(data, &m); err == nil {
+		t.Fatal("expected an error decoding a duplicate key into a map")
+	}
+	if err := d.Decode(data, &p); err == nil {
+		t.Fatal("expected an error decoding a duplicate key into a struct")
+	}
+
+	// the same key may appear in different dicts
+	if err := d.Decode([]byte("ut:d:k1:ad:k1:ai:1eee"), &m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type LenientReading struct {
+	Sensor string
+	Value  string
+	Online string
+	Count  int
+	Ratio  float64
+	Active bool
+}
+
+func TestCoerceScalars(t *testing.T) {
+	data := []byte("ut:d:k6:sensori:5ek5:valuef:1.5zk6:onlineb:1k5:counts2:42k5:ratios3:0.5k6:actives4:truee")
+
+	if err := Decode(data, &LenientReading{}); err == nil {
+		t.Fatal("expected an error decoding an int into a string without coercion")
+	}
+
+	res := LenientReading{}
+	if err := NewDecoder(WithCoerceScalars()).Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := LenientReading{"5", "1.5", "true", 42, 0.5, true}
+	if res != expected {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	if err := NewDecoder(WithCoerceScalars()).Decode([]byte("ut:d:k5:counts3:onee"), &res); err == nil {
+		t.Fatal("expected an error coercing a non-numeric string into an int")
+	}
+
+	// bools and ints are coerced into each other as 1 and 0
+	data = []byte("ut:d:k5:countb:tk5:ratiob:0k6:activei:0ee")
+	if err := Decode(data, &res); err == nil {
+		t.Fatal("expected an error decoding a bool into an int without coercion")
+	}
+
+	res = LenientReading{Active: true}
+	if err := NewDecoder(WithCoerceScalars()).Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 1 || res.Ratio != 0 || res.Active {
+		t.Fatalf("expected 1, 0 and false, got %v", res)
+	}
+
+	if err := NewDecoder(WithCoerceScalars()).Decode([]byte("ut:d:k6:activei:2ee"), &res); err == nil {
+		t.Fatal("expected an error coercing 2 into a bool")
+	}
+}
+
+func TestDecodeFloatIntoInt(t *testing.T) {
+	var i int
+	var typeErr *TypeError
+	if err := Decode([]byte("ut:f:3.0z"), &i); !errors.As(err, &typeErr) {
+		t.Fatalf("expected a *TypeError decoding a float into an int, got %v", err)
+	}
+
+	tests := []struct {
+		data     string
+		expected int
+	}{
+		{"ut:f:3.0z", 3},
+		{"ut:f:1e3z", 1000},
+		{"ut:f:2.9z", 2},
+		{"ut:f:-2.9z", -2},
+		{"ut:f:-0.5z", 0},
+	}
+
+	d := NewDecoder(WithCoerceScalars())
+	for _, test := range tests {
+		if err := d.Decode([]byte(test.data), &i); err != nil {
+			t.Fatal(err)
+		}
+		if i != test.expected {
+			t.Fatalf("expected %s to be %d, got %d", test.data, test.expected, i)
+		}
+	}
+
+	var u uint8
+	for _, data := range []string{"ut:f:256.5z", "ut:f:-1.5z", "ut:f:1e30z"} {
+		if err := d.Decode([]byte(data), &u); err == nil {
+			t.Fatalf("expected %s to be out of the uint8 range", data)
+		}
+	}
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	var v interface{}
+
+	err := Decode([]byte(""), &v)
+	if err == nil || err.Error() != "missing utcode header" {
+		t.Fatalf("expected a missing header error, got %v", err)
+	}
+
+	err = Decode([]byte("ut:"), &v)
+	if err == nil || err.Error() != "empty document" {
+		t.Fatalf("expected an empty document error, got %v", err)
+	}
+
+	err = NewDecoder(WithNoHeader()).Decode([]byte(""), &v)
+	if err == nil || err.Error() != "empty document" {
+		t.Fatalf("expected an empty document error, got %v", err)
+	}
+}
+
+func TestDecodeIntoNilPointer(t *testing.T) {
+	val := Product{Name: "pan", Quantity: 3, Image: &ProductImage{Small: "s"}}
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p *Product
+	if err := Decode(data, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || !reflect.DeepEqual(*p, val) {
+		t.Fatalf("expected %v, got %v", val, p)
+	}
+
+	// a set pointer is decoded into, not replaced
+	prev := p
+	if err := Decode([]byte("ut:d:k8:quantityi:4ee"), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p != prev || p.Quantity != 4 || p.Name != "pan" {
+		t.Fatalf("expected the same product with a new quantity, got %v", p)
+	}
+
+	var pp **Product
+	if err := Decode(data, &pp); err != nil {
+		t.Fatal(err)
+	}
+	if pp == nil || *pp == nil || !reflect.DeepEqual(**pp, val) {
+		t.Fatalf("expected %v through two pointers", val)
+	}
+}
+
+func TestDecodeNil(t *testing.T) {
+	p := &Product{Name: "pan"}
+	if err := Decode([]byte("ut:n:e"), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		t.Fatalf("expected a nil *Product, got %v", p)
+	}
+
+	// values which can't be nil are left untouched
+	i := 5
+	if err := Decode([]byte("ut:n:e"), &i); err != nil {
+		t.Fatal(err)
+	}
+	if i != 5 {
+		t.Fatalf("expected 5, got %d", i)
+	}
+
+	var v interface{} = "stale"
+	if err := Decode([]byte("ut:n:e"), &v); err != nil || v != nil {
+		t.Fatalf("expected nil, got %v: %v", v, err)
+	}
+
+	// empty documents decode the same way when allowed
+	d := NewDecoder(WithAllowEmpty())
+	for _, data := range []string{"", "ut:"} {
+		p, i = &Product{}, 5
+		if err := d.Decode([]byte(data), &p); err != nil || p != nil {
+			t.Fatalf("expected %q to decode as nil, got %v: %v", data, p, err)
+		}
+		if err := d.Decode([]byte(data), &i); err != nil || i != 5 {
+			t.Fatalf("expected %q to leave 5, got %d: %v", data, i, err)
+		}
+	}
+}
+
+// Celsius is written as text like "21.5C" by a producer
+type Celsius float64
+
+func (c *Celsius) UnmarshalText(text []byte) error {
+	return errors.New("the registered decoder should be used")
+}
+
+type Forecast struct {
+	City string
+	High Celsius
+	Lows []Celsius
+}
+
+func TestDecoderRegisterType(t *testing.T) {
+	d := NewDecoder()
+	d.RegisterType(reflect.TypeOf(Celsius(0)), func(d *Decoder, v reflect.Value) error {
+		var text string
+		if err := d.DecodeValue(&text); err != nil {
+			return err
+		}
+
+		f, err := strconv.ParseFloat(strings.TrimSuffix(text, "C"), 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+		return nil
+	})
+
+	data := "ut:d:k4:citys3:Riok4:highs5:31.5Ck4:lowsl:s3:20Cs5:18.5Cee"
+	res := Forecast{}
+	if err := d.Decode([]byte(data), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Forecast{City: "Rio", High: 31.5, Lows: []Celsius{20, 18.5}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	// other decoders keep using the text unmarshaler
+	if err := Decode([]byte(data), &res); err == nil {
+		t.Fatal("expected the text unmarshaler to fail")
+	}
+}
+
+type Audit struct {
+	Author  string `utcode:"author"`
+	Version int    `utcode:"version,default=1"`
+}
+
+type Article struct {
+	Title string `utcode:"title"`
+	Meta  Audit  `utcode:",inline"`
+}
+
+func TestInlineField(t *testing.T) {
+	val := Article{Title: "utcode", Meta: Audit{Author: "bob", Version: 3}}
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "ut:d:k5:titleu8:dXRjb2Rlk6:authoru4:Ym9ik7:versioni:3ee"
+	if string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+
+	res := Article{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != val {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+
+	// the defaults of the inline struct apply too
+	res = Article{}
+	if err := Decode([]byte("ut:d:k6:AUTHORs3:anne"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != (Article{Meta: Audit{Author: "ann", Version: 1}}) {
+		t.Fatalf("expected the default version, got %v", res)
+	}
+
+	clash := struct {
+		Author string `utcode:"author"`
+		Meta   Audit  `utcode:",inline"`
+	}{}
+	if _, err := Encode(clash); err == nil {
+		t.Fatal("expected an error for the key shared with the inline struct")
+	}
+}
+
+type Optional struct {
+	B *bool
+	I *int
+	F *float64
+	S *string
+}
+
+func TestDecodeScalarPointers(t *testing.T) {
+	tests := []struct {
+		key, value string
+		expected   interface{}
+	}{
+		{"b", "b:1", true},
+		{"i", "i:5e", 5},
+		{"f", "f:1.5z", 1.5},
+		{"s", "s3:foo", "foo"},
+	}
+
+	for _, test := range tests {
+		field := strings.ToUpper(test.key)
+		prefix := fmt.Sprintf("ut:d:k1:%s", test.key)
+
+		res := Optional{}
+		if err := Decode([]byte(prefix+test.value+"e"), &res); err != nil {
+			t.Fatal(err)
+		}
+		ptr := reflect.ValueOf(res).FieldByName(field)
+		if ptr.IsNil() || ptr.Elem().Interface() != test.expected {
+			t.Fatalf("expected %s to be %v, got %v", field, test.expected, ptr)
+		}
+
+		// a nil value leaves a nil pointer, and resets a set one
+		if err := Decode([]byte(prefix+"n:ee"), &res); err != nil {
+			t.Fatal(err)
+		}
+		if ptr := reflect.ValueOf(res).FieldByName(field); !ptr.IsNil() {
+			t.Fatalf("expected %s to be nil, got %v", field, ptr.Elem())
+		}
+	}
+}
+
+func TestDecodeLongKeys(t *testing.T) {
+	long := strings.Repeat("k", 100)
+	colons := "a:b:c:d:e:f:"
+
+	data, err := Encode(map[string]int{long: 1, colons: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "k100:"+long+"i:1e") || !strings.Contains(string(data), "k12:"+colons+"i:2e") {
+		t.Fatalf("unexpected key lengths in %s", data)
+	}
+
+	var res map[string]interface{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[long] != 1 || res[colons] != 2 {
+		t.Fatalf("unexpected %v", res)
+	}
+}
+
+func TestDecodeMapPointer(t *testing.T) {
+	data := []byte("ut:d:k1:ai:1ek1:bl:s1:xee")
+	expected := map[string]interface{}{"a": 1, "b": []interface{}{"x"}}
+
+	var m map[string]interface{}
+	if err := Decode(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected %v, got %v", expected, m)
+	}
+
+	// a pre-made map is filled in place, keeping its other entries
+	m = map[string]interface{}{"a": 0, "c": true}
+	prev := reflect.ValueOf(m).Pointer()
+	if err := Decode(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	expected["c"] = true
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected %v, got %v", expected, m)
+	}
+	if reflect.ValueOf(m).Pointer() != prev {
+		t.Fatal("expected the pre-made map to be reused")
+	}
+}
+
+func TestMaxElements(t *testing.T) {
+	list := "ut:l:" + strings.Repeat("n:e", 1000) + "e"
+	d := NewDecoder(WithMaxElements(100))
+
+	var res interface{}
+	if err := d.Decode([]byte(list), &res); err == nil {
+		t.Fatal("expected an error decoding a list over the limit")
+	}
+
+	var ints []int
+	if err := d.Decode([]byte(list), &ints); err == nil {
+		t.Fatal("expected an error decoding a typed list over the limit")
+	}
+
+	dict := "ut:d:" + strings.Repeat("k1:an:e", 101) + "e"
+	if err := d.Decode([]byte(dict), &res); err == nil {
+		t.Fatal("expected an error decoding a dict over the limit")
+	}
+	if err := d.Decode([]byte(dict), &Product{}); err == nil {
+		t.Fatal("expected an error decoding a struct over the limit")
+	}
+
+	list = "ut:l:" + strings.Repeat("i:1e", 100) + "e"
+	if err := d.Decode([]byte(list), &ints); err != nil || len(ints) != 100 {
+		t.Fatalf("expected a list at the limit to decode, got %v", err)
+	}
+}
+
+func TestDecodeIntoPopulatedStruct(t *testing.T) {
+	res := Product{
+		Name:     "default",
+		Quantity: 10,
+		Image:    &ProductImage{Large: "large.png", Small: "small.png"},
+	}
+
+	if err := Decode([]byte("ut:d:k4:names3:pane"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "pan" || res.Quantity != 10 || res.Image.Large != "large.png" {
+		t.Fatalf("expected the absent fields to keep their values, got %v", res)
+	}
+
+	// nested dicts are merged the same way
+	if err := Decode([]byte("ut:d:k5:imaged:k5:smalls5:s.pngee"), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ProductImage{Large: "large.png", Small: "s.png"}
+	if res.Name != "pan" || *res.Image != expected {
+		t.Fatalf("expected the nested absent fields to keep their values, got %v", res.Image)
+	}
+}
+
+func TestDecodeTypeMismatch(t *testing.T) {
+	tests := []struct {
+		data string
+		v    interface{}
+		msg  string
+	}{
+		{"ut:l:i:1ee", &Product{}, "cannot decode list into struct Product"},
+		{"ut:d:k1:ai:1ee", &[]int{}, "cannot decode dictionary into []int"},
+		{"ut:d:k5:imagel:ee", &Product{}, "cannot decode list into struct ProductImage"},
+		{"ut:s1:x", new(int), "cannot decode string into int"},
+		{"ut:u4:eA==", new(int), "cannot decode string into int"},
+		{"ut:b:1", new(string), "cannot decode bool into string"},
+		{"ut:i:1e", new(string), "cannot decode integer into string"},
+		{"ut:f:1.5z", new(bool), "cannot decode float into bool"},
+	}
+
+	for _, test := range tests {
+		err := Decode([]byte(test.data), test.v)
+
+		var typeErr *TypeError
+		if !errors.As(err, &typeErr) {
+			t.Fatalf("expected a *TypeError decoding %s, got %v", test.data, err)
+		}
+		if err.Error() != test.msg {
+			t.Fatalf("expected %q, got %q", test.msg, err.Error())
+		}
+	}
+}
+
+func TestWireTypeNames(t *testing.T) {
+	err := NewStreamDecoder([]byte("ut:i:1e")).DecodeField("a", new(int))
+	if err == nil || err.Error() != "expected a dictionary, got integer" {
+		t.Fatalf("expected a readable error, got %v", err)
+	}
+
+	for data, msg := range map[string]string{
+		"ut:f:1.5z": "expected a list, got float",
+		"ut:n:e":    "expected a list, got nil",
+		"ut:cx:e":   "expected a list, got custom value",
+	} {
+		if _, err := NewStreamDecoder([]byte(data)).OpenList(); err == nil || err.Error() != msg {
+			t.Fatalf("expected %q, got %v", msg, err)
+		}
+	}
+}
+
+func TestDecodeIntGrammar(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected int
+	}{
+		{"ut:i:+5e", 5},
+		{"ut:i:-5e", -5},
+		{"ut:i:010e", 10},
+		{"ut:i:9223372036854775807e", math.MaxInt64},
+	}
+
+	for _, test := range tests {
+		var res int
+		if err := Decode([]byte(test.data), &res); err != nil {
+			t.Fatalf("decoding %s: %v", test.data, err)
+		}
+		if res != test.expected {
+			t.Fatalf("expected %s to be %d, got %d", test.data, test.expected, res)
+		}
+	}
+
+	for _, data := range []string{"ut:i: 5e", "ut:i:5 e", "ut:i:0x10e", "ut:i:1_000e", "ut:i:--5e", "ut:i:9223372036854775808e"} {
+		var res int
+		err := Decode([]byte(data), &res)
+		if !errors.Is(err, strconv.ErrSyntax) && !errors.Is(err, strconv.ErrRange) {
+			t.Fatalf("expected %s to be rejected, got %v", data, err)
+		}
+	}
+}
+
+type Pixel struct {
+	Alpha int8
+	Width uint16
+}
+
+func TestDecodeIntOverflow(t *testing.T) {
+	tests := []struct {
+		data string
+		msg  string
+	}{
+		{"ut:d:k5:alphai:300ee", "cannot decode integer 300 into int8"},
+		{"ut:d:k5:widthi:70000ee", "cannot decode integer 70000 into uint16"},
+		{"ut:d:k5:widthi:-1ee", "cannot decode integer -1 into uint16"},
+	}
+
+	for _, test := range tests {
+		res := Pixel{}
+		err := Decode([]byte(test.data), &res)
+
+		var typeErr *TypeError
+		if !errors.As(err, &typeErr) {
+			t.Fatalf("expected a *TypeError decoding %s, got %v", test.data, err)
+		}
+		if err.Error() != test.msg {
+			t.Fatalf("expected %q, got %q", test.msg, err.Error())
+		}
+	}
+
+	res := Pixel{}
+	if err := Decode([]byte("ut:d:k5:alphai:-128ek5:widthi:65535ee"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != (Pixel{-128, 65535}) {
+		t.Fatalf("expected the limits to fit, got %v", res)
+	}
+}
+
+func TestDecodeStructOf(t *testing.T) {
+	typ := reflect.StructOf([]reflect.StructField{
+		{Name: "Name", Type: reflect.TypeOf("")},
+		{Name: "Count", Type: reflect.TypeOf(0), Tag: `utcode:"n"`},
+		{Name: "Tags", Type: reflect.TypeOf([]string{})},
+		{Name: "Image", Type: reflect.TypeOf(&ProductImage{})},
+	})
+
+	data := []byte("ut:d:k4:names3:fook1:ni:3ek4:tagsl:s1:as1:bek5:imaged:k5:larges0:k6:mediums0:k5:smalls1:see")
+
+	v := reflect.New(typ)
+	if err := Decode(data, v.Interface()); err != nil {
+		t.Fatal(err)
+	}
+
+	res := v.Elem()
+	if res.Field(0).String() != "foo" || res.Field(1).Int() != 3 {
+		t.Fatalf("unexpected %v", res)
+	}
+	if !reflect.DeepEqual(res.Field(2).Interface(), []string{"a", "b"}) {
+		t.Fatalf("unexpected tags %v", res.Field(2))
+	}
+	if res.Field(3).Interface().(*ProductImage).Small != "s" {
+		t.Fatalf("unexpected image %v", res.Field(3))
+	}
+
+	// and back
+	out, err := Encode(res.Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal, err := Equal(out, data); err != nil || !equal {
+		t.Fatalf("expected %s to equal %s", out, data)
+	}
+}
+
+func TestDecodeNumericKeys(t *testing.T) {
+	data := []byte("ut:d:k3:123i:1ek4:0x1fi:2ek2:-1i:3ek3:1e5i:4ek4:1:2:i:5ek1:ki:6ee")
+
+	var res map[string]interface{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"123": 1, "0x1f": 2, "-1": 3, "1e5": 4, "1:2:": 5, "k": 6}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	out, err := Encode(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal, err := Equal(out, data); err != nil || !equal {
+		t.Fatalf("expected %s to equal %s", out, data)
+	}
+}
+
+type Settings struct {
+	Quantity int     `utcode:"quantity,default=1"`
+	Unit     string  `utcode:"unit,ascii,default=kg"`
+	Enabled  bool    `utcode:",default=true"`
+	Ratio    float64 `utcode:"ratio,default=0.5"`
+	Label    string
+}
+
+func TestDecodeDefaults(t *testing.T) {
+	res := Settings{}
+	if err := Decode([]byte("ut:d:k5:labels1:xe"), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Settings{1, "kg", true, 0.5, "x"}
+	if res != expected {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	data, err := Encode(Settings{Quantity: 0, Unit: "lb", Enabled: false, Ratio: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = Settings{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	// present keys win over the defaults, even when zero
+	expected = Settings{0, "lb", false, 2, ""}
+	if res != expected {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	var bad struct {
+		N int `utcode:"n,default=one"`
+	}
+	if err := Decode([]byte("ut:d:e"), &bad); err == nil {
+		t.Fatal("expected an error for an invalid default")
+	}
+}
+
+type Shelf struct {
+	Products []Product
+	Labels   map[string]interface{}
+	Spots    [2]*Point
+}
+
+func TestDecodeConsumesTerminators(t *testing.T) {
+	nested, err := Encode(map[string]interface{}{
+		"a": []interface{}{
+			map[string]interface{}{"b": []interface{}{map[string]interface{}{}}},
+			1,
+			map[string]interface{}{"c": []interface{}{[]interface{}{}}},
+		},
+		"x": 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shelf, err := Encode(map[string]interface{}{
+		"products": []Product{{Name: "a", Image: &ProductImage{}}, {}},
+		"labels":   map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{map[string]interface{}{}}}},
+		"spots":    []Point{{1, 0}, {0, 2}},
+		"unknown":  map[string]interface{}{"a": []interface{}{map[string]interface{}{}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		data []byte
+		v    interface{}
+	}{
+		{nested, new(interface{})},
+		{nested, &map[string]interface{}{}},
+		{nested, &struct{ X int }{}},
+		{shelf, &Shelf{}},
+		{shelf, new(interface{})},
+	}
+
+	for _, test := range tests {
+		d := NewDecoder()
+		if err := d.Decode(test.data, test.v); err != nil {
+			t.Fatalf("decoding %s: %v", test.data, err)
+		}
+		if d.off != len(d.data) {
+			t.Fatalf("expected %s to be consumed, %q left", test.data, d.data[d.off:])
+		}
+
+		// the same holds for skipped values
+		d = NewStreamDecoder(test.data)
+		if err := d.DecodeField("none", new(interface{})); err != nil || d.off != len(d.data) {
+			t.Fatalf("expected %s to be skipped, %q left: %v", test.data, d.data[d.off:], err)
+		}
+	}
+}
+
+func TestTypedMapRoundTrip(t *testing.T) {
+	val := map[string]Product{
+		"pan":   {Name: "pan", Quantity: 3},
+		"shirt": {Name: "shirt", Quantity: 5, Image: &ProductImage{Large: "large"}},
+		"fork":  {Name: "fork", Description: "steel"},
+	}
+
+	e := NewEncoder(WithSortFields())
+	if err := e.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte(nil), e.Bytes()...)
+
+	// the output doesn't depend on the map iteration order
+	for i := 0; i < 10; i++ {
+		e.Reset()
+		if err := e.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(e.Bytes(), data) {
+			t.Fatalf("expected stable output %s, got %s", data, e.Bytes())
+		}
+	}
+
+	var res map[string]Product
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, val) {
+		t.Fatalf("expected %+v, got %+v", val, res)
+	}
+}
+
+type ShardKey struct {
+	Shard  int
+	Region string
+}
+
+func TestStructKeyedMapRoundTrip(t *testing.T) {
+	if _, err := Encode(map[ShardKey]int{{1, "eu"}: 1}); err == nil {
+		t.Fatal("expected an error for the unregistered key type")
+	}
+
+	RegisterMapKey(ShardKey{})
+
+	data, err := Encode(map[ShardKey]int{{3, "eu"}: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is the encoding of the struct, with its fields sorted
+	expected := "ut:d:k31:d:k6:regionu4:ZXU=k5:shardi:3eei:7ee"
+	if string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+
+	val := map[ShardKey]string{
+		{1, "eu"}: "primary",
+		{2, "us"}: "replica",
+		{1, "us"}: "",
+	}
+	if data, err = Encode(val); err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[ShardKey]string
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, val) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+
+	if err := Decode([]byte("ut:d:k5:i:1eis:1:xe"), &res); err == nil {
+		t.Fatal("expected an error for the invalid key")
+	}
+}
+
+func TestDecodeErrorUnwrap(t *testing.T) {
+	var f float64
+	err := Decode([]byte("ut:f:1.2.3z"), &f)
+	if !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("expected a syntax error, got %v", err)
+	}
+
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("expected a *DecodeError, got %T", err)
+	}
+
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) || numErr.Func != "ParseFloat" {
+		t.Fatalf("expected the *strconv.NumError of ParseFloat, got %v", err)
+	}
+}
+
+func TestPointerSliceRoundTrip(t *testing.T) {
+	a, b := 1, 2
+	data, err := Encode([]*int{&a, nil, &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ut:l:i:1en:ei:2ee" {
+		t.Fatalf("expected ut:l:i:1en:ei:2ee, got %s", data)
+	}
+
+	// the existing elements are reset to nil too
+	c := 3
+	res := []*int{nil, &c}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0] == nil || *res[0] != 1 || res[1] != nil || res[2] == nil || *res[2] != 2 {
+		t.Fatalf("expected [1 nil 2], got %v", res)
+	}
+}
+
+func TestEmptyKeyRoundTrip(t *testing.T) {
+	val := map[string]int{"": 5, "a": 1}
+	e := NewEncoder(WithSortFields())
+	if err := e.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if e.String() != "ut:d:k0:i:5ek1:ai:1ee" {
+		t.Fatalf("expected ut:d:k0:i:5ek1:ai:1ee, got %s", e.String())
+	}
+
+	var res map[string]int
+	if err := Decode(e.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, val) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+
+	var generic map[string]interface{}
+	if err := Decode(e.Bytes(), &generic); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := generic[""]; !ok || v != 5 {
+		t.Fatalf("expected the empty key to hold 5, got %v", generic)
+	}
+}
+
+func TestGenericHelpers(t *testing.T) {
+	val := Product{Name: "pan", Quantity: 3, Image: &ProductImage{Small: "s"}}
+	data, err := MarshalValue(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := DecodeTo[Product](data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, val) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+
+	if data, err = MarshalValue(42); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := DecodeTo[int](data); err != nil || n != 42 {
+		t.Fatalf("expected 42, got %v: %v", n, err)
+	}
+
+	if _, err := DecodeTo[int]([]byte("ut:s1:x")); err == nil {
+		t.Fatal("expected an error decoding a string into an int")
+	}
+}
+
+func TestInternStrings(t *testing.T) {
+	data, err := Encode([]map[string]string{{"status": "active"}, {"status": "active"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := func(d *Decoder) bool {
+		var res []map[string]string
+		if err := d.Decode(data, &res); err != nil {
+			t.Fatal(err)
+		}
+		return unsafe.StringData(res[0]["status"]) == unsafe.StringData(res[1]["status"])
+	}
+
+	if shared(NewDecoder()) {
+		t.Fatal("expected the strings to be distinct without interning")
+	}
+	if !shared(NewDecoder(WithInternStrings())) {
+		t.Fatal("expected the strings to share their memory")
+	}
+}
+
+func TestDecodeMultiPointerSlice(t *testing.T) {
+	var res []**int
+	if err := Decode([]byte("ut:l:i:1en:ei:2ee"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0] == nil || **res[0] != 1 || res[1] != nil || res[2] == nil || **res[2] != 2 {
+		t.Fatalf("expected [1 nil 2], got %v", res)
+	}
+
+	a, b := 1, 2
+	pa, pb := &a, &b
+	data, err := Encode([]**int{&pa, nil, &pb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ut:l:i:1en:ei:2ee" {
+		t.Fatalf("expected ut:l:i:1en:ei:2ee, got %s", data)
+	}
+
+	var products []*Product
+	if err := Decode([]byte("ut:l:d:k4:names3:panen:ee"), &products); err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products[0] == nil || products[0].Name != "pan" || products[1] != nil {
+		t.Fatalf("expected [pan nil], got %v", products)
+	}
+}
+
+type Tags []string
+
+type Meta map[string]string
+
+type Attrs map[string]interface{}
+
+type Post struct {
+	Tags  Tags
+	Meta  Meta
+	Attrs Attrs
+}
+
+func TestDecodeNamedContainerFields(t *testing.T) {
+	val := Post{
+		Tags:  Tags{"go", "utcode"},
+		Meta:  Meta{"author": "ann"},
+		Attrs: Attrs{"views": 3, "pinned": true},
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := Post{}
+	if err := Decode(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, val) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+}
+
+func TestReuseSlices(t *testing.T) {
+	res := make([]Product, 3, 8)
+	res[0] = Product{Name: "stale", Description: "old"}
+	res[2] = Product{Name: "trailing"}
+	backing := &res[:cap(res)][0]
+
+	d := NewDecoder(WithReuseSlices())
+	if err := d.Decode([]byte("ut:l:d:k4:names3:paned:k8:quantityi:2eee"), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	// the elements are reset, and the slice truncated, in the same array
+	expected := []Product{{Name: "pan"}, {Quantity: 2}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+	if &res[0] != backing {
+		t.Fatal("expected the backing array to be reused")
+	}
+
+	var names []interface{}
+	if err := d.Decode([]byte("ut:l:s1:ai:1ee"), &names); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []interface{}{"a", 1}) {
+		t.Fatalf("expected [a 1], got %v", names)
+	}
+}
+
+func BenchmarkDecodeReusedSlice(b *testing.B) {
+	val := make([]Product, 100)
+	for i := range val {
+		val[i] = Product{Name: fmt.Sprintf("product%d", i), Quantity: i}
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse=%v", reuse), func(b *testing.B) {
+			d := NewDecoder()
+			d.ReuseSlices = reuse
+
+			var res []Product
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !reuse {
+					res = nil
+				}
+				if err := d.Decode(data, &res); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
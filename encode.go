@@ -2,12 +2,19 @@ package utcode
 
 import (
 	"bytes"
+	"database/sql/driver"
+	"encoding"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"reflect"
-	"runtime"
-	"strings"
+	"io"
 	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 // Encode will encode the value using the default Encoder
@@ -20,72 +27,242 @@ func Encode(v interface{}) ([]byte, error) {
 	return e.Bytes(), nil
 }
 
+// MarshalValue will encode the value of type T using the default Encoder,
+// it's the typed counterpart of Encode
+func MarshalValue[T any](v T) ([]byte, error) {
+	return Encode(v)
+}
+
+var (
+	// pooledEncoders are the default Encoders with a reused buffer
+	pooledEncoders = sync.Pool{New: func() interface{} { return new(Encoder) }}
+)
+
+// EncodeTo will encode the value to w using the default Encoder. The output
+// goes through a reused buffer instead of a new []byte, and nothing is
+// written when the encoding fails.
+func EncodeTo(w io.Writer, v interface{}) error {
+	e := pooledEncoders.Get().(*Encoder)
+	defer pooledEncoders.Put(e)
+
+	e.Reset()
+	if err := e.Encode(v); err != nil {
+		return err
+	}
+	_, err := e.WriteTo(w)
+	return err
+}
+
+// EncodedLen returns the length of what Encode would produce for v. It runs
+// the encoding, so it's exact even with custom encoders, but into a reused
+// buffer, so the output isn't allocated.
+func EncodedLen(v interface{}) (int, error) {
+	e := pooledEncoders.Get().(*Encoder)
+	defer pooledEncoders.Put(e)
+
+	e.Reset()
+	if err := e.Encode(v); err != nil {
+		return 0, err
+	}
+	return e.Len(), nil
+}
+
 // Encoder contains the output buffer of the value encoded
 // and allows to register custom type encoders
 type Encoder struct {
 	bytes.Buffer
 	custom map[reflect.Kind]typeEncoder
+
+	// TypeNames tags the dicts of structs registered with RegisterName
+	// with their name, under the reserved TypeKey
+	TypeNames bool
+
+	// OmitHeader leaves out the "ut:" header, for when the framing is
+	// external. It must be decoded with Decoder.NoHeader.
+	OmitHeader bool
+
+	// NilAsEmpty encodes nil slices and maps as empty lists and dicts
+	// instead of nil, for consumers that can't handle the nil marker
+	NilAsEmpty bool
+
+	// UseJSONMarshaler encodes the types implementing json.Marshaler as their
+	// JSON in a unicode string, it must be decoded with Decoder.UseJSONUnmarshaler
+	UseJSONMarshaler bool
+
+	// DurationAsString encodes time.Duration values as their String form
+	// (e.g. "1h30m0s") instead of nanoseconds, both are decoded
+	DurationAsString bool
+
+	// AllowUintptr allows encoding uintptr values as ints, which is
+	// refused by default since a memory address is meaningless elsewhere
+	AllowUintptr bool
+
+	// BytesAsList encodes byte slices and arrays as lists of ints instead of
+	// strings, for consumers expecting numbers. By default they're unicode
+	// strings whatever their content, so any byte round-trips. Both forms
+	// decode into them, ints out of the byte range failing.
+	BytesAsList bool
+
+	// SortFields encodes the struct fields sorted by their keys instead of
+	// in declaration order, and the map entries sorted by their keys, for
+	// diffing tools and stable output. The type name stays first.
+	SortFields bool
+
+	// RunesAsString encodes rune slices as strings instead of lists of ints.
+	// A rune is an int32, so every []int32 is affected, and the values which
+	// aren't valid runes are replaced by U+FFFD. Strings decode into a []rune
+	// regardless.
+	RunesAsString bool
+
+	// BoolLetters encodes bools as b:t and b:f instead of b:1 and b:0, for
+	// implementations using letters. The Decoder accepts both forms.
+	BoolLetters bool
+
+	// RequireTag encodes only the struct fields with a tag, so that new
+	// fields aren't leaked by accident, see Decoder.RequireTag
+	RequireTag bool
+
+	// EnumsAsStrings encodes the values of the enums registered with
+	// RegisterEnum as their names instead of ints, for readable payloads
+	EnumsAsStrings bool
+
+	// Flatten writes the entries of the dicts nested in the top-level one
+	// into it, under their keys joined by dots (e.g. "image.large"), for flat
+	// key-value stores. It must be decoded with Decoder.Unflatten, and the
+	// keys must not hold dots. Custom values must follow the layout expected
+	// by the Tokenizer.
+	Flatten bool
+
+	// Base64Encoding is the alphabet of the unicode strings, StdEncoding
+	// when nil. It may be URLEncoding for payloads embedded in URLs, but
+	// the consumers must set the same Decoder.Base64Encoding.
+	Base64Encoding *base64.Encoding
 }
 
-func NewEncoder() *Encoder {
+// NewEncoder returns an Encoder configured with the given options
+func NewEncoder(opts ...EncoderOption) *Encoder {
 	e := &Encoder{
 		custom: make(map[reflect.Kind]typeEncoder),
 	}
+	for _, opt := range opts {
+		opt(e)
+	}
 	return e
 }
 
 // Encode the value to utcode, returns an error if there's any
-func (e *Encoder) Encode(v interface{}) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if _, ok := r.(runtime.Error); ok {
-				panic(r)
-			}
-			if s, ok := r.(string); ok {
-				panic(s)
-			}
-			err = r.(error)
-		}
-	}()
-
+func (e *Encoder) Encode(v interface{}) error {
 	value := reflect.ValueOf(v)
 
-	e.WriteString("ut:")
-	e.encodeType(value)
+	if !e.OmitHeader {
+		e.WriteString("ut:")
+	}
+	if !e.Flatten {
+		return e.encodeType(value)
+	}
 
-	return nil
+	start := e.Len()
+	if err := e.encodeType(value); err != nil {
+		return err
+	}
+
+	data := append([]byte(nil), e.Bytes()[start:]...)
+	e.Truncate(start)
+	return e.flatten(data)
 }
 
-// Register a custom type encoder
+// Register a custom type encoder, it takes precedence over the
+// package-level encoders and the built-in encoder for that kind
 func (e *Encoder) Register(t reflect.Kind, encoder typeEncoder) {
+	if e.custom == nil {
+		e.custom = make(map[reflect.Kind]typeEncoder)
+	}
 	e.custom[t] = encoder
 }
 
-func (e *Encoder) encodeType(v reflect.Value) {
+var (
+	customEncoders = make(map[reflect.Kind]typeEncoder)
+)
+
+// RegisterEncoder registers a custom type encoder for every Encoder,
+// including the one used by Encode. It takes precedence over the built-in
+// encoder for that kind, but not over one registered on the Encoder itself.
+// It is not safe for concurrent use and should be called during initialization.
+func RegisterEncoder(t reflect.Kind, encoder typeEncoder) {
+	customEncoders[t] = encoder
+}
+
+func (e *Encoder) encodeType(v reflect.Value) error {
+	if e.UseJSONMarshaler {
+		if m, ok := marshaler(v, jsonMarshalerType); ok {
+			return jsonEncoder(e, m.(json.Marshaler))
+		}
+	}
+
+	if isValuer(v) {
+		return valuerEncoder(e, v)
+	}
+
+	if v.IsValid() && v.Type() == errorType {
+		return errorEncoder(e, v)
+	}
+
+	if e.DurationAsString && v.IsValid() && v.Type() == durationType {
+		return stringEncoder(e, reflect.ValueOf(time.Duration(v.Int()).String()))
+	}
+
+	if e.EnumsAsStrings && v.IsValid() {
+		if name, ok := enumName(v); ok {
+			return stringEncoder(e, reflect.ValueOf(name))
+		}
+	}
+
+	if m, ok := marshaler(v, textMarshalerType); ok {
+		return textEncoder(e, m.(encoding.TextMarshaler))
+	}
+
+	if m, ok := marshaler(v, binaryMarshalerType); ok {
+		return binaryEncoder(e, m.(encoding.BinaryMarshaler))
+	}
+
+	if isOpaqueError(v) {
+		return errorEncoder(e, v)
+	}
+
 	encoder := e.typeEncoder(v.Kind())
 	if encoder == nil {
 		if v.IsValid() {
-			panic(fmt.Errorf("unsupported encode type %v", v.Kind()))
-		} else {
-			e.WriteString("n:e")
+			return &UnsupportedTypeError{Kind: v.Kind()}
 		}
 
-		return
+		e.WriteString("n:e")
+		return nil
 	}
 
-	encoder(e, v)
+	return encoder(e, v)
 }
 
 func (e *Encoder) typeEncoder(t reflect.Kind) typeEncoder {
+	if encoder, ok := e.custom[t]; ok {
+		return encoder
+	}
+	if encoder, ok := customEncoders[t]; ok {
+		return encoder
+	}
+
 	switch t {
 	case reflect.Bool:
 		return boolEncoder
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return intEncoder
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return uintEncoder
+	case reflect.Uintptr:
+		return uintptrEncoder
 	case reflect.Float32, reflect.Float64:
 		return floatEncoder
+	case reflect.Complex64, reflect.Complex128:
+		return complexEncoder
 	case reflect.String:
 		return stringEncoder
 	case reflect.Struct:
@@ -99,119 +276,554 @@ func (e *Encoder) typeEncoder(t reflect.Kind) typeEncoder {
 	case reflect.Ptr, reflect.Interface:
 		return ptrEncoder
 	default:
-		encoder, ok := e.custom[t]
-		if !ok {
-			return nil
-		}
-		return encoder
+		return nil
+	}
+}
+
+// UnsupportedTypeError is returned when encoding a value of a kind
+// which has no encoder, like funcs and channels, or uintptrs unless
+// Encoder.AllowUintptr is set
+type UnsupportedTypeError struct {
+	Kind reflect.Kind
+
+	// Key is the key of the innermost map holding the value, if HasKey
+	Key    string
+	HasKey bool
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.HasKey {
+		return fmt.Sprintf("unsupported type %v at key %q", e.Kind, e.Key)
+	}
+	return fmt.Sprintf("unsupported type %v", e.Kind)
+}
+
+// The writers below format straight into the buffer, so that no
+// intermediate strings are allocated
+
+func (e *Encoder) writeInt(i int64) {
+	b := append(e.AvailableBuffer(), 'i', ':')
+	b = strconv.AppendInt(b, i, 10)
+	e.Write(append(b, 'e'))
+}
+
+// writeLength writes the code and the length prefixing a string or a key
+func (e *Encoder) writeLength(code byte, n int) {
+	b := append(e.AvailableBuffer(), code)
+	b = strconv.AppendInt(b, int64(n), 10)
+	e.Write(append(b, ':'))
+}
+
+func (e *Encoder) writeKey(key string) {
+	e.writeLength('k', len(key))
+	e.WriteString(key)
+}
+
+func (e *Encoder) base64() *base64.Encoding {
+	if e.Base64Encoding != nil {
+		return e.Base64Encoding
 	}
+	return base64.StdEncoding
 }
 
-type typeEncoder func(e *Encoder, v reflect.Value)
+// writeUnicode writes the data as a unicode string
+func (e *Encoder) writeUnicode(data []byte) {
+	enc := e.base64()
+	n := enc.EncodedLen(len(data))
+	e.writeLength('u', n)
+	e.Grow(n)
 
-func boolEncoder(e *Encoder, v reflect.Value) {
+	b := e.AvailableBuffer()[:n]
+	enc.Encode(b, data)
+	e.Write(b)
+}
+
+// writeUnicodeString writes the string as a unicode string, it's copied to
+// the encoding in chunks so it isn't converted to a []byte as a whole
+func (e *Encoder) writeUnicodeString(str string) {
+	enc := e.base64()
+	n := enc.EncodedLen(len(str))
+	e.writeLength('u', n)
+	e.Grow(n)
+
+	// a multiple of 3 bytes, so only the last chunk is padded
+	var chunk [3 * 256]byte
+	for len(str) > 0 {
+		m := copy(chunk[:], str)
+		str = str[m:]
+
+		b := e.AvailableBuffer()[:enc.EncodedLen(m)]
+		enc.Encode(b, chunk[:m])
+		e.Write(b)
+	}
+}
+
+type typeEncoder func(e *Encoder, v reflect.Value) error
+
+func boolEncoder(e *Encoder, v reflect.Value) error {
 	e.WriteString("b:")
-	if v.Bool() {
+	switch {
+	case v.Bool() && e.BoolLetters:
+		e.WriteString("t")
+	case v.Bool():
 		e.WriteString("1")
-	} else {
+	case e.BoolLetters:
+		e.WriteString("f")
+	default:
 		e.WriteString("0")
 	}
+	return nil
 }
 
-func intEncoder(e *Encoder, v reflect.Value) {
-	e.WriteString(fmt.Sprintf("i:%ve", v.Int()))
+func intEncoder(e *Encoder, v reflect.Value) error {
+	e.writeInt(v.Int())
+	return nil
 }
 
-func uintEncoder(e *Encoder, v reflect.Value) {
-	e.WriteString(fmt.Sprintf("i:%ve", v.Uint()))
+func uintEncoder(e *Encoder, v reflect.Value) error {
+	b := append(e.AvailableBuffer(), 'i', ':')
+	b = strconv.AppendUint(b, v.Uint(), 10)
+	e.Write(append(b, 'e'))
+	return nil
 }
 
-func floatEncoder(e *Encoder, v reflect.Value) {
-	var result string
+func uintptrEncoder(e *Encoder, v reflect.Value) error {
+	if !e.AllowUintptr {
+		return &UnsupportedTypeError{Kind: v.Kind()}
+	}
+	return uintEncoder(e, v)
+}
+
+func floatEncoder(e *Encoder, v reflect.Value) error {
 	f := v.Float()
-	if f == math.Floor(f) {
-		result = fmt.Sprintf("i:%ve", f)
-	} else {
-		result = fmt.Sprintf("f:%vz", f)
+	// integral floats use the int form, as long as they fit in an int64
+	// (float64(math.MaxInt64) rounds up to 2^63, hence the strict bound)
+	if f == math.Floor(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		e.writeInt(int64(f))
+		return nil
 	}
-	e.WriteString(result)
+
+	b := append(e.AvailableBuffer(), 'f', ':')
+	b = strconv.AppendFloat(b, f, 'g', -1, 64)
+	e.Write(append(b, 'z'))
+	return nil
 }
 
-func stringEncoder(e *Encoder, v reflect.Value) {
-	b64 := base64.StdEncoding.EncodeToString([]byte(v.String()))
-	e.WriteString(fmt.Sprintf("u%v:%v", len(b64), b64))
+// complexEncoder encodes a complex number as the list of its real
+// and imaginary parts, which follow the rules of the floats
+func complexEncoder(e *Encoder, v reflect.Value) error {
+	c := v.Complex()
+	e.WriteString("l:")
+	floatEncoder(e, reflect.ValueOf(real(c)))
+	floatEncoder(e, reflect.ValueOf(imag(c)))
+	e.WriteString("e")
+	return nil
+}
+
+func stringEncoder(e *Encoder, v reflect.Value) error {
+	e.writeUnicodeString(v.String())
+	return nil
 }
 
-func structEncoder(e *Encoder, v reflect.Value) {
+// asciiStringEncoder encodes the string in the raw 's' form, failing
+// if it has content outside of the ASCII range
+func asciiStringEncoder(e *Encoder, name string, v reflect.Value) error {
+	str := v.String()
+	for i := 0; i < len(str); i++ {
+		if str[i] >= utf8.RuneSelf {
+			return fmt.Errorf("non-ASCII content in ascii field %q", name)
+		}
+	}
+
+	e.writeLength('s', len(str))
+	e.WriteString(str)
+	return nil
+}
+
+func structEncoder(e *Encoder, v reflect.Value) error {
 	e.WriteString("d:")
 
 	t := v.Type()
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		if field.PkgPath != "" {
+	if name, ok := typeToName[t]; ok && e.TypeNames {
+		e.writeKey(TypeKey)
+		if err := stringEncoder(e, reflect.ValueOf(name)); err != nil {
+			return err
+		}
+	}
+
+	info := cachedStruct(t)
+	if info.invalid != nil {
+		return info.invalid
+	}
+
+	fields := info.fields
+	if e.SortFields {
+		fields = info.sorted
+	}
+
+	for _, field := range fields {
+		if e.RequireTag && !field.tagged {
 			continue
 		}
 
-		name, tag := field.Name, field.Tag.Get(TagName)
-		if tag == "" {
-			name = strings.ToLower(name[:1]) + name[1:]
-		} else {
-			name = tag
+		name, opts := field.name, field.opts
+		value := v.FieldByIndex(field.index)
+		if opts.Contains("omitempty") && isEmptyValue(value) {
+			continue
 		}
+		e.writeKey(name)
 
-		e.WriteString(fmt.Sprintf("k%v:%v", len(name), name))
-		e.encodeType(v.FieldByName(field.Name))
+		var err error
+		if value.Kind() == reflect.String && opts.Contains("ascii") {
+			err = asciiStringEncoder(e, name, value)
+		} else if value.Kind() == reflect.String && opts.Contains("b64") {
+			err = stringEncoder(e, value)
+		} else {
+			err = e.encodeType(value)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	e.WriteString("e")
+	return nil
 }
 
-func mapEncoder(e *Encoder, v reflect.Value) {
-	if v.IsNil() {
+// Omitter is implemented by the types defining their own emptiness, which
+// is consulted instead of the zero value for fields tagged omitempty
+type Omitter interface {
+	IsZeroForUTCode() bool
+}
+
+var (
+	omitterType = reflect.TypeOf((*Omitter)(nil)).Elem()
+)
+
+// isEmptyValue reports whether a field tagged omitempty is left out: when
+// it's an empty array, map, slice or string, the zero value of other types,
+// or an Omitter reporting so
+func isEmptyValue(v reflect.Value) bool {
+	if m, ok := marshaler(v, omitterType); ok {
+		return m.(Omitter).IsZeroForUTCode()
+	}
+
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+func mapEncoder(e *Encoder, v reflect.Value) error {
+	if v.IsNil() && !e.NilAsEmpty {
 		e.WriteString("n:e")
+		return nil
 	}
 
-	e.WriteString("d:")
-	for _, k := range v.MapKeys() {
-		if k.Type().Kind() != reflect.String {
-			panic("map encoding supports only string as key")
+	if !isMapKeyType(v.Type().Key()) {
+		return fmt.Errorf("map encoding supports only string and registered types as key")
+	}
+
+	keys := make([]string, v.Len())
+	values := make([]reflect.Value, v.Len())
+	iter := v.MapRange()
+	for i := 0; iter.Next(); i++ {
+		key, err := e.mapKey(iter.Key())
+		if err != nil {
+			return err
 		}
+		keys[i], values[i] = key, iter.Value()
+	}
+	if e.SortFields {
+		sort.Sort(mapEntries{keys, values})
+	}
 
-		str := k.String()
-		e.WriteString(fmt.Sprintf("k%v:%v", len(str), str))
+	e.WriteString("d:")
+	for i, key := range keys {
+		e.writeKey(key)
 
-		e.encodeType(v.MapIndex(k))
+		if err := e.encodeType(values[i]); err != nil {
+			if ut, ok := err.(*UnsupportedTypeError); ok && !ut.HasKey {
+				ut.Key, ut.HasKey = key, true
+			}
+			return err
+		}
 	}
 	e.WriteString("e")
+	return nil
 }
 
-var (
-	bytesType = reflect.ValueOf([]byte{}).Type()
-)
+// mapKey returns the dict key of a map key, see RegisterMapKey
+func (e *Encoder) mapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
 
-func sliceEncoder(e *Encoder, v reflect.Value) {
-	if v.IsNil() {
+	// the key is encoded at the end of the buffer, and cut from it
+	start, sorted := e.Len(), e.SortFields
+	e.SortFields = true
+	err := e.encodeType(k)
+	e.SortFields = sorted
+
+	key := string(e.Bytes()[start:])
+	e.Truncate(start)
+	return key, err
+}
+
+// mapEntries sorts the entries of a map by their keys
+type mapEntries struct {
+	keys   []string
+	values []reflect.Value
+}
+
+func (m mapEntries) Len() int           { return len(m.keys) }
+func (m mapEntries) Less(i, j int) bool { return m.keys[i] < m.keys[j] }
+func (m mapEntries) Swap(i, j int) {
+	m.keys[i], m.keys[j] = m.keys[j], m.keys[i]
+	m.values[i], m.values[j] = m.values[j], m.values[i]
+}
+
+func sliceEncoder(e *Encoder, v reflect.Value) error {
+	if v.Kind() == reflect.Slice && v.IsNil() && !e.NilAsEmpty {
 		e.WriteString("n:e")
-		return
+		return nil
+	}
+
+	// byte slices, named ones included, are encoded as strings
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 && !e.BytesAsList {
+		e.writeUnicode(v.Bytes())
+		return nil
 	}
 
-	if v.Type() == bytesType {
-		stringEncoder(e, reflect.ValueOf(string(v.Bytes())))
-		return
+	// so are byte arrays, like UUIDs and hashes
+	if v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && !e.BytesAsList {
+		// one by one, the element type may be a named byte type
+		data := make([]byte, v.Len())
+		for i := range data {
+			data[i] = byte(v.Index(i).Uint())
+		}
+		e.writeUnicode(data)
+		return nil
+	}
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Int32 && e.RunesAsString {
+		runes := make([]rune, v.Len())
+		for i := range runes {
+			runes[i] = rune(v.Index(i).Int())
+		}
+		e.writeUnicodeString(string(runes))
+		return nil
 	}
 
 	e.WriteString("l:")
 	for i := 0; i < v.Len(); i++ {
-		e.encodeType(v.Index(i))
+		if err := e.encodeType(v.Index(i)); err != nil {
+			return err
+		}
 	}
 	e.WriteString("e")
+	return nil
+}
+
+var (
+	valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+func isValuer(v reflect.Value) bool {
+	if !v.IsValid() || !hasMethods(v.Type(), valuerType) {
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return !v.IsNil()
+	default:
+		return true
+	}
+}
+
+// valuerEncoder encodes a driver.Valuer through the result of its Value method,
+// which is one of the driver.Value types (or nil)
+func valuerEncoder(e *Encoder, v reflect.Value) error {
+	val, err := v.Interface().(driver.Valuer).Value()
+	if err != nil {
+		return err
+	}
+
+	return e.encodeType(reflect.ValueOf(val))
+}
+
+var (
+	errorType           = reflect.TypeOf((*error)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+)
+
+// errorEncoder encodes an error as its message, see isOpaqueError for the
+// concrete types taking this path
+func errorEncoder(e *Encoder, v reflect.Value) error {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		e.WriteString("n:e")
+		return nil
+	}
+
+	return stringEncoder(e, reflect.ValueOf(v.Interface().(error).Error()))
+}
+
+// isOpaqueError reports whether v is an error with nothing to encode but its
+// message, like the ones of errors.New and fmt.Errorf. The errors which are
+// structs with exported fields are encoded as dicts instead, and the ones
+// with a marshaler never get here.
+func isOpaqueError(v reflect.Value) bool {
+	if !v.IsValid() || !hasMethods(v.Type(), errorType) {
+		return false
+	}
+
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMethods reports whether t implements the interface iface by itself.
+// The methods promoted from embedded fields don't count, so a struct
+// embedding a time.Time is encoded as a struct and not as a time. A method
+// only counts as the struct's own when no embedded field provides it for
+// the receiver, since reflection can't tell a redeclared method apart.
+func hasMethods(t, iface reflect.Type) bool {
+	key := methodsKey{t, iface}
+	if ok, found := methodsCache.Load(key); found {
+		return ok.(bool)
+	}
+
+	ok, _ := methodsCache.LoadOrStore(key, implementsItself(t, iface))
+	return ok.(bool)
+}
+
+// methodsKey is a type and an interface, see hasMethods
+type methodsKey struct {
+	t, iface reflect.Type
+}
+
+var (
+	methodsCache sync.Map // map[methodsKey]bool
+)
+
+func implementsItself(t, iface reflect.Type) bool {
+	if !t.Implements(iface) {
+		return false
+	}
+
+	st, ptr := t, false
+	if st.Kind() == reflect.Ptr {
+		st, ptr = st.Elem(), true
+	}
+	if st.Kind() != reflect.Struct {
+		return true
+	}
+
+	for i := 0; i < iface.NumMethod(); i++ {
+		if isPromoted(st, ptr, iface.Method(i).Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPromoted reports whether the method name of the struct st, or of *st
+// when ptr is set, is promoted from one of its embedded fields. Two fields
+// providing it cancel out, in which case the struct declares it.
+func isPromoted(st reflect.Type, ptr bool, name string) bool {
+	n := 0
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if !f.Anonymous {
+			continue
+		}
+
+		// the pointer methods of a value field are only promoted to *st
+		ft := f.Type
+		if ptr && ft.Kind() != reflect.Ptr && ft.Kind() != reflect.Interface {
+			ft = reflect.PtrTo(ft)
+		}
+		if _, ok := ft.MethodByName(name); ok {
+			n++
+		}
+	}
+	return n == 1
+}
+
+// marshaler returns the value as the marshaler interface t, through
+// its address when only the pointer implements it and it's addressable
+func marshaler(v reflect.Value, t reflect.Type) (interface{}, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+
+	if hasMethods(v.Type(), t) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return nil, false
+		}
+		return v.Interface(), true
+	}
+
+	if v.CanAddr() && hasMethods(reflect.PtrTo(v.Type()), t) {
+		return v.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+// textEncoder encodes the text of an encoding.TextMarshaler as a unicode
+// string, so it round-trips exactly (e.g. decimals keep their precision)
+func textEncoder(e *Encoder, m encoding.TextMarshaler) error {
+	text, err := m.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	return stringEncoder(e, reflect.ValueOf(string(text)))
+}
+
+// binaryEncoder encodes the data of an encoding.BinaryMarshaler as a unicode
+// string, it's only used for the types which don't marshal to text
+func binaryEncoder(e *Encoder, m encoding.BinaryMarshaler) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return stringEncoder(e, reflect.ValueOf(string(data)))
+}
+
+// jsonEncoder encodes the JSON of a json.Marshaler as a unicode string
+func jsonEncoder(e *Encoder, m json.Marshaler) error {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	return stringEncoder(e, reflect.ValueOf(string(data)))
 }
 
-func ptrEncoder(e *Encoder, v reflect.Value) {
+func ptrEncoder(e *Encoder, v reflect.Value) error {
 	if v.IsNil() {
 		e.WriteString("n:e")
-		return
+		return nil
 	}
 
-	e.encodeType(v.Elem())
+	return e.encodeType(v.Elem())
 }
@@ -0,0 +1,79 @@
+package utcode
+
+import (
+	"math"
+	"reflect"
+)
+
+// Equal reports whether the documents a and b hold the same value, which
+// is not the same as being byte-equal since the dict keys may come in any
+// order. Numbers are compared by their value, so the int 3 equals the float
+// 3.0, and ints are compared exactly; NaN equals nothing, like in Go.
+// Custom values are compared with reflect.DeepEqual.
+func Equal(a, b []byte) (bool, error) {
+	var va, vb interface{}
+	if err := Decode(a, &va); err != nil {
+		return false, err
+	}
+	if err := Decode(b, &vb); err != nil {
+		return false, err
+	}
+	return equalValues(va, vb), nil
+}
+
+func equalValues(a, b interface{}) bool {
+	switch a := a.(type) {
+	case int:
+		switch b := b.(type) {
+		case int:
+			return a == b
+		case float64:
+			return equalIntFloat(a, b)
+		}
+		return false
+	case float64:
+		switch b := b.(type) {
+		case int:
+			return equalIntFloat(b, a)
+		case float64:
+			return a == b
+		}
+		return false
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+
+		for k, va := range a {
+			vb, ok := b[k]
+			if !ok || !equalValues(va, vb) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+
+		for i := range a {
+			if !equalValues(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// equalIntFloat compares i and f exactly, converting f to an int when it's
+// integral and in range rather than i to a float, which may round it
+func equalIntFloat(i int, f float64) bool {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return false
+	}
+	return int64(f) == int64(i)
+}
@@ -0,0 +1,41 @@
+package utcode
+
+import (
+	"testing"
+)
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"ut:d:k1:ai:1ek1:bu4:Zm9ve", "ut:d:k1:bs3:fook1:ai:1ee", true},
+		{"ut:d:k1:ad:k1:xn:ek1:yb:1eee", "ut:d:k1:ad:k1:yb:1k1:xn:eee", true},
+		{"ut:d:k1:ai:1ee", "ut:d:k1:ai:1ek1:bi:2ee", false},
+		{"ut:d:k1:an:ee", "ut:d:k1:bn:ee", false},
+		{"ut:l:i:1ei:2ee", "ut:l:i:2ei:1ee", false},
+		{"ut:i:3e", "ut:f:3.0z", true},
+		{"ut:f:0.5z", "ut:f:5e-1z", true},
+		{"ut:i:3e", "ut:f:3.5z", false},
+		{"ut:i:3e", "ut:s1:3", false},
+		{"ut:i:9007199254740993e", "ut:i:9007199254740992e", false},
+		{"ut:i:9223372036854775807e", "ut:f:9223372036854775808z", false},
+		{"ut:f:-9223372036854775808z", "ut:i:-9223372036854775808e", true},
+		{"ut:f:NaNz", "ut:f:NaNz", false},
+		{"ut:n:e", "ut:n:e", true},
+	}
+
+	for _, test := range tests {
+		equal, err := Equal([]byte(test.a), []byte(test.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if equal != test.equal {
+			t.Errorf("expected Equal(%s, %s) to be %v", test.a, test.b, test.equal)
+		}
+	}
+
+	if _, err := Equal([]byte("ut:i:1e"), []byte("ut:i:1")); err == nil {
+		t.Fatal("expected an error comparing an invalid document")
+	}
+}
@@ -0,0 +1,149 @@
+package utcode
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+)
+
+// flatDict is a dict being flattened into its parent, see Encoder.Flatten
+type flatDict struct {
+	key   string // the key of the dict, with the ones of its parents
+	empty bool
+}
+
+// flatten writes the top-level dict of the encoded value with the entries of
+// its nested dicts inlined under dotted keys. The values of other types are
+// copied as they are, so the dicts within lists aren't flattened.
+func (e *Encoder) flatten(data []byte) error {
+	t := NewTokenizer(bytes.NewReader(data))
+	t.NoHeader, t.Base64Encoding = true, e.Base64Encoding
+
+	if tok, err := t.Next(); err != nil {
+		return err
+	} else if tok.Kind != DictStart {
+		e.Write(data)
+		return nil
+	}
+
+	e.WriteString("d:")
+	dicts := []flatDict{{empty: true}}
+	for len(dicts) > 0 {
+		tok, err := t.Next()
+		if err != nil {
+			return err
+		}
+
+		top := dicts[len(dicts)-1]
+		if tok.Kind == DictEnd {
+			dicts = dicts[:len(dicts)-1]
+			if len(dicts) == 0 {
+				e.WriteString("e")
+			} else if top.empty {
+				// empty dicts have no entries to carry their key
+				e.writeKey(top.key)
+				e.WriteString("d:e")
+			}
+			continue
+		}
+
+		dicts[len(dicts)-1].empty = false
+		key := tok.Value.(string)
+		if len(dicts) > 1 {
+			key = top.key + "." + key
+		}
+
+		val, err := t.Next()
+		if err != nil {
+			return err
+		}
+		if val.Kind == DictStart {
+			dicts = append(dicts, flatDict{key: key, empty: true})
+			continue
+		}
+
+		if err := t.skipOpened(val); err != nil {
+			return err
+		}
+		e.writeKey(key)
+		e.Write(data[val.Offset:t.off])
+	}
+	return nil
+}
+
+// unflatten reads the document at the start of data, turning the dotted keys
+// of its top-level dict back into nested dicts. The keys of a nested dict
+// must be contiguous, as Encoder.Flatten writes them. It returns the document
+// along with the length read from data.
+func unflatten(t *Tokenizer, data string) (string, int, error) {
+	tok, err := t.Next()
+	if err != nil {
+		return "", 0, t.unexpected(err)
+	}
+	if tok.Kind != DictStart {
+		err := t.skipOpened(tok)
+		return data[:t.off], t.off, err
+	}
+
+	var out Encoder
+	out.WriteString("d:")
+
+	// open holds the keys of the nested dicts written so far
+	var open []string
+	for {
+		tok, err := t.Next()
+		if err != nil {
+			return "", 0, t.unexpected(err)
+		}
+		if tok.Kind == DictEnd {
+			break
+		}
+
+		path := strings.Split(tok.Value.(string), ".")
+		path, leaf := path[:len(path)-1], path[len(path)-1]
+
+		n := 0
+		for n < len(open) && n < len(path) && open[n] == path[n] {
+			n++
+		}
+		for ; len(open) > n; open = open[:len(open)-1] {
+			out.WriteString("e")
+		}
+		for _, key := range path[n:] {
+			out.writeKey(key)
+			out.WriteString("d:")
+			open = append(open, key)
+		}
+
+		val, err := t.Next()
+		if err != nil {
+			return "", 0, t.unexpected(err)
+		}
+		if err := t.skipOpened(val); err != nil {
+			return "", 0, err
+		}
+		out.writeKey(leaf)
+		out.WriteString(data[val.Offset:t.off])
+	}
+
+	out.WriteString(strings.Repeat("e", len(open)+1))
+	return out.String(), t.off, nil
+}
+
+// decodeUnflattened decodes the document at the current offset written by
+// Encoder.Flatten, see Decoder.Unflatten
+func (d *Decoder) decodeUnflattened(v interface{}) error {
+	t := NewTokenizer(strings.NewReader(d.data[d.off:]))
+	t.NoHeader, t.Base64Encoding = true, d.Base64Encoding
+
+	doc, n, err := unflatten(t, d.data[d.off:])
+	if err != nil {
+		return err
+	}
+
+	data, end := d.data, d.off+n
+	d.data, d.off = doc, 0
+	err = d.decodeValue(reflect.ValueOf(v))
+	d.data, d.off = data, end
+	return err
+}
@@ -0,0 +1,55 @@
+package utcode
+
+import (
+	"reflect"
+	"testing"
+)
+
+type Catalog struct {
+	Title    string            `utcode:"title,ascii"`
+	Featured Product           `utcode:"featured"`
+	Labels   map[string]string `utcode:"labels"`
+	Items    []ProductImage    `utcode:"items"`
+}
+
+func TestFlattenRoundTrip(t *testing.T) {
+	val := Catalog{
+		Title:    "summer",
+		Featured: Product{Name: "hat", Quantity: 2, Image: &ProductImage{Large: "l"}},
+		Labels:   map[string]string{},
+		Items:    []ProductImage{{Small: "s"}},
+	}
+
+	e := NewEncoder(WithFlatten())
+	if err := e.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dicts in lists and the empty ones are left nested
+	expected := "ut:d:k5:titles6:summer" +
+		"k13:featured.nameu4:aGF0k20:featured.descriptionu0:k17:featured.quantityi:2e" +
+		"k20:featured.image.largeu4:bA==k21:featured.image.mediumu0:k20:featured.image.smallu0:" +
+		"k6:labelsd:ek5:itemsl:d:k5:largeu0:k6:mediumu0:k5:smallu4:cw==eee"
+	if e.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, e.String())
+	}
+
+	res := Catalog{}
+	if err := NewDecoder(WithUnflatten()).Decode(e.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, val) {
+		t.Fatalf("expected %+v, got %+v", val, res)
+	}
+
+	// every document of a stream is unflattened
+	stream := append(append([]byte(nil), e.Bytes()...), "\nut:i:5e"...)
+	docs, err := NewStreamDecoder(stream, WithUnflatten()).DecodeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	featured := docs[0].(map[string]interface{})["featured"].(map[string]interface{})
+	if len(docs) != 2 || featured["quantity"] != 2 || docs[1] != 5 {
+		t.Fatalf("unexpected %v", docs)
+	}
+}
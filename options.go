@@ -0,0 +1,151 @@
+package utcode
+
+import (
+	"encoding/base64"
+)
+
+// EncoderOption configures an Encoder created by NewEncoder
+type EncoderOption func(e *Encoder)
+
+// WithTypeNames sets Encoder.TypeNames
+func WithTypeNames() EncoderOption {
+	return func(e *Encoder) { e.TypeNames = true }
+}
+
+// WithOmitHeader sets Encoder.OmitHeader
+func WithOmitHeader() EncoderOption {
+	return func(e *Encoder) { e.OmitHeader = true }
+}
+
+// WithNilAsEmpty sets Encoder.NilAsEmpty
+func WithNilAsEmpty() EncoderOption {
+	return func(e *Encoder) { e.NilAsEmpty = true }
+}
+
+// WithJSONMarshaler sets Encoder.UseJSONMarshaler
+func WithJSONMarshaler() EncoderOption {
+	return func(e *Encoder) { e.UseJSONMarshaler = true }
+}
+
+// WithDurationAsString sets Encoder.DurationAsString
+func WithDurationAsString() EncoderOption {
+	return func(e *Encoder) { e.DurationAsString = true }
+}
+
+// WithUintptr sets Encoder.AllowUintptr
+func WithUintptr() EncoderOption {
+	return func(e *Encoder) { e.AllowUintptr = true }
+}
+
+// WithBytesAsList sets Encoder.BytesAsList
+func WithBytesAsList() EncoderOption {
+	return func(e *Encoder) { e.BytesAsList = true }
+}
+
+// WithSortFields sets Encoder.SortFields
+func WithSortFields() EncoderOption {
+	return func(e *Encoder) { e.SortFields = true }
+}
+
+// WithRunesAsString sets Encoder.RunesAsString
+func WithRunesAsString() EncoderOption {
+	return func(e *Encoder) { e.RunesAsString = true }
+}
+
+// WithBoolLetters sets Encoder.BoolLetters
+func WithBoolLetters() EncoderOption {
+	return func(e *Encoder) { e.BoolLetters = true }
+}
+
+// WithRequireTag sets Encoder.RequireTag
+func WithRequireTag() EncoderOption {
+	return func(e *Encoder) { e.RequireTag = true }
+}
+
+// WithEnumsAsStrings sets Encoder.EnumsAsStrings
+func WithEnumsAsStrings() EncoderOption {
+	return func(e *Encoder) { e.EnumsAsStrings = true }
+}
+
+// WithFlatten sets Encoder.Flatten
+func WithFlatten() EncoderOption {
+	return func(e *Encoder) { e.Flatten = true }
+}
+
+// WithBase64Encoding sets Encoder.Base64Encoding
+func WithBase64Encoding(enc *base64.Encoding) EncoderOption {
+	return func(e *Encoder) { e.Base64Encoding = enc }
+}
+
+// DecoderOption configures a Decoder created by NewDecoder or NewStreamDecoder
+type DecoderOption func(d *Decoder)
+
+// WithNoHeader sets Decoder.NoHeader
+func WithNoHeader() DecoderOption {
+	return func(d *Decoder) { d.NoHeader = true }
+}
+
+// WithJSONUnmarshaler sets Decoder.UseJSONUnmarshaler
+func WithJSONUnmarshaler() DecoderOption {
+	return func(d *Decoder) { d.UseJSONUnmarshaler = true }
+}
+
+// WithTrace sets Decoder.Trace
+func WithTrace(trace func(event TraceEvent)) DecoderOption {
+	return func(d *Decoder) { d.Trace = trace }
+}
+
+// WithNumberKind sets Decoder.NumberKind
+func WithNumberKind(kind NumberKind) DecoderOption {
+	return func(d *Decoder) { d.NumberKind = kind }
+}
+
+// WithDisallowDuplicateKeys sets Decoder.DisallowDuplicateKeys
+func WithDisallowDuplicateKeys() DecoderOption {
+	return func(d *Decoder) { d.DisallowDuplicateKeys = true }
+}
+
+// WithCoerceScalars sets Decoder.CoerceScalars
+func WithCoerceScalars() DecoderOption {
+	return func(d *Decoder) { d.CoerceScalars = true }
+}
+
+// WithMaxElements sets Decoder.MaxElements
+func WithMaxElements(max int) DecoderOption {
+	return func(d *Decoder) { d.MaxElements = max }
+}
+
+// WithInternStrings sets Decoder.InternStrings
+func WithInternStrings() DecoderOption {
+	return func(d *Decoder) { d.InternStrings = true }
+}
+
+// WithRequireTagDecoding sets Decoder.RequireTag
+func WithRequireTagDecoding() DecoderOption {
+	return func(d *Decoder) { d.RequireTag = true }
+}
+
+// WithReuseSlices sets Decoder.ReuseSlices
+func WithReuseSlices() DecoderOption {
+	return func(d *Decoder) { d.ReuseSlices = true }
+}
+
+// WithUnflatten sets Decoder.Unflatten
+func WithUnflatten() DecoderOption {
+	return func(d *Decoder) { d.Unflatten = true }
+}
+
+// WithMaxDocuments sets Decoder.MaxDocuments
+func WithMaxDocuments(max int) DecoderOption {
+	return func(d *Decoder) { d.MaxDocuments = max }
+}
+
+// WithBase64Decoding sets Decoder.Base64Encoding
+func WithBase64Decoding(enc *base64.Encoding) DecoderOption {
+	return func(d *Decoder) { d.Base64Encoding = enc }
+}
+
+// WithAllowEmpty sets Decoder.AllowEmpty
+func WithAllowEmpty() DecoderOption {
+	return func(d *Decoder) { d.AllowEmpty = true }
+}
@@ -0,0 +1,51 @@
+package utcode
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+	e := NewEncoder(WithOmitHeader(), WithNilAsEmpty(), WithDurationAsString())
+	if !e.OmitHeader || !e.NilAsEmpty || !e.DurationAsString || e.TypeNames {
+		t.Fatalf("unexpected encoder options %+v", e)
+	}
+
+	val := map[string]interface{}{
+		"list":    []int(nil),
+		"timeout": 90 * time.Second,
+	}
+	if err := e.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+
+	var events int
+	d := NewDecoder(
+		WithNoHeader(),
+		WithNumberKind(Number32),
+		WithDisallowDuplicateKeys(),
+		WithTrace(func(event TraceEvent) { events++ }),
+	)
+
+	res := map[string]interface{}{}
+	if err := d.Decode(e.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"list":    []interface{}{},
+		"timeout": "1m30s",
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+	if events == 0 {
+		t.Fatal("expected the trace option to be set")
+	}
+
+	s := NewStreamDecoder(e.Bytes(), WithNoHeader())
+	if err := s.DecodeNext(&res); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,192 @@
+package utcode
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// TypeKey is the reserved dict key holding the registered name of
+	// the struct type, written when Encoder.TypeNames is set
+	TypeKey = "@type"
+)
+
+var (
+	nameToType = make(map[string]reflect.Type)
+	typeToName = make(map[reflect.Type]string)
+
+	// enums maps the enum types to their values by name
+	enums = make(map[reflect.Type]map[string]reflect.Value)
+
+	typeKeyPrefix = fmt.Sprintf("k%v:%v", len(TypeKey), TypeKey)
+)
+
+// RegisterName records the concrete type of sample, a struct or a pointer
+// to a struct, under the given name. Dicts tagged with the name are decoded
+// into a new value of that type when the destination is an interface,
+// like encoding/gob does. This is required to decode dicts into interface
+// fields other than interface{}, embedded ones included. It is not safe
+// for concurrent use and should be called during initialization.
+func RegisterName(name string, sample interface{}) {
+	t := reflect.TypeOf(sample)
+	st := t
+	if st != nil && st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+
+	if st == nil || st.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("utcode: cannot register %v, only structs can be named", t))
+	}
+
+	if old, ok := nameToType[name]; ok && old != t {
+		panic(fmt.Sprintf("utcode: registering duplicate types for %q: %v != %v", name, old, t))
+	}
+
+	nameToType[name] = t
+	typeToName[st] = name
+}
+
+// decodeNamed decodes a dict tagged with a registered type name into a new
+// value of that type, returning a pointer to it. It consumes nothing and
+// returns false when the dict isn't tagged.
+func (d *Decoder) decodeNamed() (reflect.Value, bool, error) {
+	if !strings.HasPrefix(d.data[d.off:], typeKeyPrefix) {
+		return reflect.Value{}, false, nil
+	}
+	d.off += len(typeKeyPrefix)
+
+	var name string
+	if err := d.decodeType(reflect.ValueOf(&name)); err != nil {
+		return reflect.Value{}, true, err
+	}
+
+	t, ok := nameToType[name]
+	if !ok {
+		return reflect.Value{}, true, NewDecodeError(fmt.Sprintf("unregistered type name %q", name))
+	}
+
+	st := t
+	if t.Kind() == reflect.Ptr {
+		st = t.Elem()
+	}
+
+	val := reflect.New(st)
+	if err := fillStruct(d, val.Elem()); err != nil {
+		return reflect.Value{}, true, err
+	}
+	if err := d.readEnd(); err != nil {
+		return reflect.Value{}, true, err
+	}
+
+	if t.Kind() == reflect.Ptr {
+		ptr := reflect.New(t)
+		ptr.Elem().Set(val)
+		return ptr, true, nil
+	}
+	return val, true, nil
+}
+
+// decodeNamedInto decodes a dict tagged with a registered type name into
+// the nil interface v, whose methods the type must implement
+func (d *Decoder) decodeNamedInto(v reflect.Value) error {
+	val, ok, err := d.decodeNamed()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &TypeError{wireTypeName('d'), v.Type()}
+	}
+
+	if !val.Elem().Type().AssignableTo(v.Type()) {
+		return NewDecodeError(fmt.Sprintf("cannot decode %v into %v", val.Elem().Type(), v.Type()))
+	}
+	v.Set(val.Elem())
+	return nil
+}
+
+var (
+	stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// RegisterEnum records the values of an enum, a named integer type
+// implementing fmt.Stringer, given as a slice, e.g. []Status{Active, Closed}.
+// The values are encoded as their String when Encoder.EnumsAsStrings is set,
+// and every Decoder decodes them from it, as well as from ints. It is not
+// safe for concurrent use and should be called during initialization.
+func RegisterEnum(values interface{}) {
+	t := reflect.TypeOf(values)
+	if t == nil || t.Kind() != reflect.Slice || !isEnumType(t.Elem()) {
+		panic(fmt.Sprintf("utcode: cannot register %v, only slices of integer types implementing fmt.Stringer are enums", t))
+	}
+
+	v := reflect.ValueOf(values)
+	names := make(map[string]reflect.Value, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		names[v.Index(i).Interface().(fmt.Stringer).String()] = v.Index(i)
+	}
+	enums[t.Elem()] = names
+}
+
+func isEnumType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return t.Name() != "" && t.Implements(stringerType)
+	default:
+		return false
+	}
+}
+
+// enumName returns the name of a registered enum value, the values which
+// weren't registered have none
+func enumName(v reflect.Value) (string, bool) {
+	names, ok := enums[v.Type()]
+	if !ok {
+		return "", false
+	}
+
+	name := v.Interface().(fmt.Stringer).String()
+	if val, ok := names[name]; ok && val.Interface() == v.Interface() {
+		return name, true
+	}
+	return "", false
+}
+
+// enumDecoder decodes a registered enum value from its name
+func enumDecoder(d *Decoder, names map[string]reflect.Value, v reflect.Value) error {
+	str, _, err := d.decodeString(v)
+	if err != nil {
+		return err
+	}
+
+	val, ok := names[str]
+	if !ok {
+		return NewDecodeError(fmt.Sprintf("unknown %v %q", v.Type().Elem(), str))
+	}
+	v.Elem().Set(val)
+	return nil
+}
+
+var (
+	// mapKeys are the struct types registered as map keys
+	mapKeys = make(map[reflect.Type]bool)
+)
+
+// RegisterMapKey allows maps keyed by the struct type of sample, like
+// composite cache keys. The keys are encoded as dict keys holding their
+// encoding without the header, with the fields sorted so that equal keys
+// have the same one, and decoded back from it. It is not safe for
+// concurrent use and should be called during initialization.
+func RegisterMapKey(sample interface{}) {
+	t := reflect.TypeOf(sample)
+	if t == nil || t.Kind() != reflect.Struct || !t.Comparable() {
+		panic(fmt.Sprintf("utcode: cannot register %v, only comparable structs can be map keys", t))
+	}
+	mapKeys[t] = true
+}
+
+// isMapKeyType reports whether the maps keyed by t can be encoded
+func isMapKeyType(t reflect.Type) bool {
+	return t.Kind() == reflect.String || mapKeys[t]
+}
@@ -0,0 +1,189 @@
+package utcode
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type Shape interface {
+	Area() float64
+}
+
+type Square struct {
+	Side float64
+}
+
+func (s Square) Area() float64 {
+	return s.Side * s.Side
+}
+
+type Circle struct {
+	Radius float64
+}
+
+func (c *Circle) Area() float64 {
+	return 3 * c.Radius * c.Radius
+}
+
+type Drawing struct {
+	Title      string
+	Background Shape
+	Shapes     []Shape
+}
+
+func init() {
+	RegisterName("square", Square{})
+	RegisterName("circle", &Circle{})
+	RegisterEnum([]Status{Pending, Active, Closed})
+}
+
+func TestRegisteredNamesRoundTrip(t *testing.T) {
+	val := Drawing{
+		Title:      "shapes",
+		Background: Square{10},
+		Shapes:     []Shape{&Circle{1.5}, Square{2}},
+	}
+
+	e := NewEncoder()
+	e.TypeNames = true
+	if err := e.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+
+	res := Drawing{}
+	if err := Decode(e.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(val, res) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+}
+
+func TestDecodeIntoRegisteredInterface(t *testing.T) {
+	e := NewEncoder(WithTypeNames())
+	if err := e.Encode(Square{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var shape Shape
+	if err := Decode(e.Bytes(), &shape); err != nil {
+		t.Fatal(err)
+	}
+	if shape != (Square{2}) {
+		t.Fatalf("expected a square, got %v", shape)
+	}
+
+	// the type must implement the interface
+	var stringer fmt.Stringer
+	if err := Decode(e.Bytes(), &stringer); err == nil {
+		t.Fatal("expected an error decoding a square into a fmt.Stringer")
+	}
+
+	e.Reset()
+	if err := e.Encode(map[string]interface{}{"background": &Circle{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var res Drawing
+	if err := Decode(e.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := res.Background.(*Circle); !ok || c.Radius != 1 {
+		t.Fatalf("expected a circle, got %v", res.Background)
+	}
+}
+
+type Framed struct {
+	Shape
+	Label string
+}
+
+func TestEmbeddedInterfaceField(t *testing.T) {
+	val := Framed{Square{3}, "framed"}
+
+	e := NewEncoder()
+	e.TypeNames = true
+	if err := e.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+
+	res := Framed{}
+	if err := Decode(e.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(val, res) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without the type name there's nothing to allocate for the interface
+	if err := Decode(data, &Framed{}); err == nil {
+		t.Fatal("expected an error decoding an untagged dict into an embedded interface")
+	}
+}
+
+type Status int
+
+const (
+	Pending Status = iota
+	Active
+	Closed
+)
+
+func (s Status) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Active:
+		return "active"
+	case Closed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type Ticket struct {
+	ID     int
+	Status Status
+	Log    []Status
+}
+
+func TestEnumsAsStrings(t *testing.T) {
+	val := Ticket{ID: 1, Status: Active, Log: []Status{Pending, Active, Status(9)}}
+	e := NewEncoder(WithEnumsAsStrings())
+	if err := e.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+
+	// values without a name stay ints
+	expected := "ut:d:k2:iDi:1ek6:statusu8:YWN0aXZlk3:logl:u12:cGVuZGluZw==u8:YWN0aXZli:9eee"
+	if e.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, e.String())
+	}
+
+	res := Ticket{}
+	if err := Decode(e.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, val) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+
+	if err := Decode([]byte("ut:d:k6:statuss4:openee"), &res); err == nil {
+		t.Fatal("expected an error for an unknown name")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic registering a type without String")
+		}
+	}()
+	RegisterEnum([]int{1, 2})
+}
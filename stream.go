@@ -0,0 +1,449 @@
+package utcode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// NewStreamDecoder returns a Decoder reading a stream of concatenated
+// documents, optionally separated by newlines, from data
+func NewStreamDecoder(data []byte, opts ...DecoderOption) *Decoder {
+	d := NewDecoder(opts...)
+	d.data = string(data)
+	return d
+}
+
+// NewReaderDecoder returns a Decoder reading a stream of documents from r,
+// see NewStreamDecoder. Each document is read whole before it's decoded,
+// but for the lists opened with OpenList, read element by element,
+// retrying the short reads common on network connections, and the reads
+// are buffered, so r may be read past the last document decoded. Custom
+// values must follow the layout expected by the Tokenizer.
+func NewReaderDecoder(r io.Reader, opts ...DecoderOption) *Decoder {
+	d := NewDecoder(opts...)
+	d.src = NewTokenizer(r)
+	return d
+}
+
+// Reset makes d read the stream of documents in data, as if it was returned
+// by NewStreamDecoder, keeping its options and registered decoders. It allows
+// reusing Decoders, e.g. from a sync.Pool.
+func (d *Decoder) Reset(data []byte) {
+	d.data = string(data)
+	d.off = 0
+	d.docs = 0
+	d.interned = nil
+	d.src = nil
+}
+
+// ResetReader makes d read the stream of documents from r, as if it was
+// returned by NewReaderDecoder, see Reset. The read buffer is reused.
+func (d *Decoder) ResetReader(r io.Reader) {
+	d.data = ""
+	d.off = 0
+	d.docs = 0
+	d.interned = nil
+	if d.src == nil {
+		d.src = NewTokenizer(r)
+		return
+	}
+
+	t := d.src
+	t.r.Reset(r)
+	*t = Tokenizer{r: t.r, captured: t.captured[:0]}
+}
+
+// DecodeReader decodes the first document read from r into v
+func DecodeReader(r io.Reader, v interface{}) error {
+	err := NewReaderDecoder(r).DecodeNext(v)
+	if err == io.EOF {
+		return NewDecodeError("missing utcode header")
+	}
+	return err
+}
+
+// WriteFrame encodes v using the default Encoder and writes it to w as a
+// frame: the length of the document as 4 big-endian bytes, then the document.
+// Nothing is written when the encoding fails.
+func WriteFrame(w io.Writer, v interface{}) error {
+	e := pooledEncoders.Get().(*Encoder)
+	defer pooledEncoders.Put(e)
+
+	e.Reset()
+	e.Write(make([]byte, 4))
+	if err := e.Encode(v); err != nil {
+		return err
+	}
+
+	n := e.Len() - 4
+	if uint64(n) > math.MaxUint32 {
+		return fmt.Errorf("document of %d bytes is too large for a frame", n)
+	}
+	binary.BigEndian.PutUint32(e.Bytes(), uint32(n))
+
+	_, err := e.WriteTo(w)
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame from r and decodes its
+// document into v using the default Decoder. It returns io.EOF when r ends
+// before the frame, and io.ErrUnexpectedEOF when it ends within it. The
+// buffer grows as the document is read, so a corrupt length fails at the
+// end of r rather than allocating its size upfront.
+func ReadFrame(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+
+	// the buffer grows with what's read, not with the length claimed
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, int64(binary.BigEndian.Uint32(header[:]))); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return Decode(data.Bytes(), v)
+}
+
+// fill reads the next document from the reader into data
+func (d *Decoder) fill() error {
+	t := d.src
+	t.NoHeader = d.NoHeader
+	t.Base64Encoding = d.Base64Encoding
+	if err := t.skipSeparators(); err != nil {
+		return err
+	}
+
+	t.captured = t.captured[:0]
+	t.capture = true
+	defer func() { t.capture = false }()
+
+	for {
+		if _, err := t.Next(); err != nil {
+			return t.unexpected(err)
+		}
+		if !t.inDoc {
+			break
+		}
+	}
+
+	d.data = string(t.captured)
+	d.off = 0
+	return nil
+}
+
+// DecodeNext decodes the next document of the stream into v,
+// returning io.EOF when there are no documents left
+func (d *Decoder) DecodeNext(v interface{}) error {
+	if err := d.nextDocument(); err != nil {
+		return err
+	}
+
+	return d.decodeDocument(v)
+}
+
+// More reports whether there is another document left in the stream
+func (d *Decoder) More() bool {
+	return d.next() == nil
+}
+
+// DecodeAll decodes every document left in the stream
+func (d *Decoder) DecodeAll() ([]interface{}, error) {
+	var res []interface{}
+	for {
+		var v interface{}
+		if err := d.DecodeNext(&v); err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return res, err
+		}
+
+		res = append(res, v)
+	}
+}
+
+// next moves to the next document of the stream, reading it first
+// for the reader-backed decoders, or returns io.EOF
+func (d *Decoder) next() error {
+	d.skipSeparators()
+	if d.off < len(d.data) {
+		return nil
+	}
+
+	if d.src == nil {
+		return io.EOF
+	}
+	return d.fill()
+}
+
+// nextDocument moves to the next document to decode, see next,
+// counting it against Decoder.MaxDocuments
+func (d *Decoder) nextDocument() error {
+	if err := d.next(); err != nil {
+		return err
+	}
+	return d.countDocument()
+}
+
+// countDocument counts a document against Decoder.MaxDocuments
+func (d *Decoder) countDocument() error {
+	if d.MaxDocuments > 0 && d.docs >= d.MaxDocuments {
+		return NewDecodeError(fmt.Sprintf("too many documents, the limit is %d", d.MaxDocuments))
+	}
+	d.docs++
+	return nil
+}
+
+func (d *Decoder) skipSeparators() {
+	for d.off < len(d.data) && (d.data[d.off] == '\n' || d.data[d.off] == '\r') {
+		d.off++
+	}
+}
+
+// DecodeField decodes only the value under key of the next document, which
+// must be a dict, skipping the values of every other key. The whole dict is
+// consumed, and v is left untouched when the key isn't there.
+func (d *Decoder) DecodeField(key string, v interface{}) error {
+	if err := d.nextDocument(); err != nil {
+		return err
+	}
+
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+
+	if typ, err := d.readTypeKey(); err != nil {
+		return err
+	} else if typ != "d" {
+		return NewDecodeError(fmt.Sprintf("expected a dictionary, got %s", wireTypeName(typ[0])))
+	}
+
+	for d.peek() != 'e' {
+		k, err := dictKey(d)
+		if err != nil {
+			return err
+		}
+
+		if k == key {
+			err = d.decodeValue(reflect.ValueOf(v))
+		} else {
+			err = d.skipValue()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return d.readEnd()
+}
+
+// RawUTCode is an encoded value, without the header, whose decoding is
+// deferred until Resolve, see Decoder.DecodeLazy
+type RawUTCode struct {
+	// Data is the encoded value, starting with its type code
+	Data string
+
+	// d is the Decoder which read the value, whose options it's decoded with
+	d *Decoder
+}
+
+// Type returns the type code of the value, like Peek, or 0 when it's empty
+func (r *RawUTCode) Type() byte {
+	if len(r.Data) == 0 {
+		return 0
+	}
+	return r.Data[0]
+}
+
+// Resolve decodes the value into v, which must be a non-nil pointer or map,
+// with the options and registered decoders of the Decoder which read it, or
+// the default Decoder. It may be called any number of times.
+func (r *RawUTCode) Resolve(v interface{}) error {
+	d := r.d
+	if d == nil {
+		d = new(Decoder)
+	}
+	if len(r.Data) == 0 {
+		return NewDecodeError("empty document")
+	}
+
+	// the value is decoded in place of the current document, restored after
+	data, off := d.data, d.off
+	d.data, d.off = r.Data, 0
+
+	var err error
+	if d.Unflatten {
+		err = d.decodeUnflattened(v)
+	} else {
+		err = d.decodeValue(reflect.ValueOf(v))
+	}
+
+	d.data, d.off = data, off
+	return err
+}
+
+// DecodeLazy reads the next document of the stream into v, which must be a
+// non-nil *RawUTCode, only scanning its value up to its end. The value is
+// decoded when RawUTCode.Resolve is called, sparing the work for the dicts
+// and lists of a batch which aren't needed in full.
+func (d *Decoder) DecodeLazy(v interface{}) error {
+	raw, ok := v.(*RawUTCode)
+	if !ok || raw == nil {
+		return NewDecodeError(fmt.Sprintf("cannot decode lazily into %T, it must be a non-nil *RawUTCode", v))
+	}
+
+	if err := d.nextDocument(); err != nil {
+		return err
+	}
+
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	if d.off >= len(d.data) {
+		return NewDecodeError("empty document")
+	}
+
+	start := d.off
+	if err := d.skipValue(); err != nil {
+		return err
+	}
+	*raw = RawUTCode{Data: d.data[start:d.off], d: d}
+	return nil
+}
+
+// ListDecoder decodes the elements of a list one at a time, see OpenList
+type ListDecoder struct {
+	d    *Decoder
+	done bool
+
+	// src is the Tokenizer the elements are read from, for the
+	// reader-backed decoders
+	src *Tokenizer
+}
+
+// OpenList starts decoding the next document of the stream, which must be a
+// list, element by element, so it's never materialized as a whole. The list
+// must be read up to its end before decoding further documents.
+func (d *Decoder) OpenList() (*ListDecoder, error) {
+	if d.skipSeparators(); d.off >= len(d.data) && d.src != nil {
+		return d.openReaderList()
+	}
+
+	if err := d.nextDocument(); err != nil {
+		return nil, err
+	}
+
+	if err := d.readHeader(); err != nil {
+		return nil, err
+	}
+
+	if typ, err := d.readTypeKey(); err != nil {
+		return nil, err
+	} else if typ != "l" {
+		return nil, NewDecodeError(fmt.Sprintf("expected a list, got %s", wireTypeName(typ[0])))
+	}
+	return &ListDecoder{d: d}, nil
+}
+
+// openReaderList opens the next document read from the reader, which must
+// be a list, leaving its elements to be read by ListDecoder.Next, see fill
+func (d *Decoder) openReaderList() (*ListDecoder, error) {
+	t := d.src
+	t.NoHeader = d.NoHeader
+	t.Base64Encoding = d.Base64Encoding
+	if err := t.skipSeparators(); err != nil {
+		return nil, err
+	}
+	if err := d.countDocument(); err != nil {
+		return nil, err
+	}
+
+	if !d.NoHeader {
+		if _, err := t.Next(); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := t.r.Peek(1)
+	if err != nil {
+		return nil, t.unexpected(err)
+	}
+	tok, err := t.Next()
+	if err != nil {
+		return nil, t.unexpected(err)
+	}
+
+	if tok.Kind != ListStart {
+		// the document is skipped, so the stream can go on
+		if err := t.skipOpened(tok); err != nil {
+			return nil, err
+		}
+		return nil, NewDecodeError(fmt.Sprintf("expected a list, got %s", wireTypeName(b[0])))
+	}
+	return &ListDecoder{d: d, src: t}, nil
+}
+
+// Next decodes the next element into v, returning false once the end of
+// the list is reached, in which case v is left untouched
+func (l *ListDecoder) Next(v interface{}) (bool, error) {
+	if l.done {
+		return false, nil
+	}
+	if l.src != nil {
+		return l.nextRead(v)
+	}
+
+	if l.d.peek() == 'e' {
+		l.done = true
+		return false, l.d.readEnd()
+	}
+
+	if err := l.d.decodeValue(reflect.ValueOf(v)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// nextRead reads the next element from the reader into v, see Next. Only the
+// element is held in memory while it's decoded.
+func (l *ListDecoder) nextRead(v interface{}) (bool, error) {
+	t := l.src
+	b, err := t.r.Peek(1)
+	if err != nil {
+		return false, t.unexpected(err)
+	}
+	if b[0] == 'e' {
+		l.done = true
+		_, err := t.Next()
+		return false, err
+	}
+
+	t.captured = t.captured[:0]
+	t.capture = true
+	tok, err := t.Next()
+	if err == nil {
+		err = t.skipOpened(tok)
+	}
+	t.capture = false
+	if err != nil {
+		return false, t.unexpected(err)
+	}
+
+	// the element is decoded in place of the current document, restored after
+	d := l.d
+	data, off := d.data, d.off
+	d.data, d.off = string(t.captured), 0
+	err = d.decodeValue(reflect.ValueOf(v))
+	d.data, d.off = data, off
+
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,384 @@
+package utcode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecodeAll(t *testing.T) {
+	var stream []byte
+	for _, v := range []interface{}{42, "foo", map[string]interface{}{"a": []interface{}{true, nil}}} {
+		data, err := Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, data...)
+		stream = append(stream, '\n')
+	}
+
+	res, err := NewStreamDecoder(stream).DecodeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{42, "foo", map[string]interface{}{"a": []interface{}{true, nil}}}
+	if !reflect.DeepEqual(expected, res) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestMaxDocuments(t *testing.T) {
+	stream := []byte("ut:i:1e\nut:i:2e\nut:i:3e")
+
+	res, err := NewStreamDecoder(stream, WithMaxDocuments(2)).DecodeAll()
+	if err == nil || err.Error() != "too many documents, the limit is 2" {
+		t.Fatalf("expected a limit error, got %v", err)
+	}
+	if !reflect.DeepEqual(res, []interface{}{1, 2}) {
+		t.Fatalf("expected the documents up to the limit, got %v", res)
+	}
+
+	if res, err = NewStreamDecoder(stream, WithMaxDocuments(3)).DecodeAll(); err != nil || len(res) != 3 {
+		t.Fatalf("expected 3 documents, got %v: %v", res, err)
+	}
+}
+
+func TestDecodeField(t *testing.T) {
+	val := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		val[fmt.Sprintf("key%d", i)] = map[string]interface{}{"n": i, "tags": []string{"a", "b"}}
+	}
+
+	first, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Encode("next")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewStreamDecoder(append(first, second...))
+
+	var res struct{ N int }
+	if err := d.DecodeField("key42", &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 42 {
+		t.Fatalf("expected 42, got %v", res.N)
+	}
+
+	var next string
+	if err := d.DecodeNext(&next); err != nil {
+		t.Fatal(err)
+	}
+	if next != "next" {
+		t.Fatalf("expected the dict to be consumed, got %q", next)
+	}
+}
+
+func TestDecodeLazy(t *testing.T) {
+	d := NewStreamDecoder([]byte("ut:d:k4:names3:pank8:quantityi:3ee\nut:l:i:1ei:2ee\nut:i:7e"))
+
+	var order, items, count RawUTCode
+	for _, raw := range []*RawUTCode{&order, &items, &count} {
+		if err := d.DecodeLazy(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if order.Type() != 'd' || order.Data != "d:k4:names3:pank8:quantityi:3ee" {
+		t.Fatalf("expected the dict to be deferred, got %c %q", order.Type(), order.Data)
+	}
+	if d.More() {
+		t.Fatal("expected the stream to be consumed")
+	}
+
+	// the values are decoded once the documents are read
+	var res Product
+	if err := order.Resolve(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "pan" || res.Quantity != 3 {
+		t.Fatalf("expected the dict to be resolved, got %+v", res)
+	}
+
+	var list []int
+	if err := items.Resolve(&list); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]int{1, 2}, list) {
+		t.Fatalf("expected [1 2], got %v", list)
+	}
+
+	if err := d.DecodeLazy(&res); err == nil {
+		t.Fatal("expected an error for a destination other than *RawUTCode")
+	}
+	if err := new(RawUTCode).Resolve(&res); err == nil {
+		t.Fatal("expected an error for an empty value")
+	}
+}
+
+func TestDecoderMore(t *testing.T) {
+	d := NewStreamDecoder([]byte("ut:i:1e\nut:i:2e\r\nut:i:3e\n"))
+
+	var res []int
+	for d.More() {
+		var v int
+		if err := d.DecodeNext(&v); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, v)
+	}
+
+	if !reflect.DeepEqual([]int{1, 2, 3}, res) {
+		t.Fatalf("expected [1 2 3], got %v", res)
+	}
+}
+
+func TestOpenList(t *testing.T) {
+	const count = 100000
+
+	// the list is streamed, never held whole by either end
+	r, w := io.Pipe()
+	go func() {
+		e := NewEncoder()
+		e.OmitHeader = true
+		w.Write([]byte("ut:l:"))
+		for i := 0; i < count; i++ {
+			e.Reset()
+			if err := e.Encode(Point{i, -i}); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			e.WriteTo(w)
+		}
+		w.Write([]byte("e\nut:d:k1:ai:1ee\nut:l:i:1ee"))
+		w.Close()
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	d := NewReaderDecoder(r)
+	list, err := d.OpenList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for {
+		var p Point
+		ok, err := list.Next(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+
+		if p.X != n || p.Y != -n {
+			t.Fatalf("expected {%d %d}, got %v", n, -n, p)
+		}
+		n++
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	if n != count {
+		t.Fatalf("expected %d elements, got %d", count, n)
+	}
+	if after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > 1<<20 {
+		t.Fatalf("expected bounded memory, the heap grew by %d bytes", after.HeapAlloc-before.HeapAlloc)
+	}
+
+	// a document other than a list is skipped
+	if _, err := d.OpenList(); err == nil || err.Error() != "expected a list, got dictionary" {
+		t.Fatalf("expected a list error, got %v", err)
+	}
+	var rest []int
+	if err := d.DecodeNext(&rest); err != nil || !reflect.DeepEqual(rest, []int{1}) {
+		t.Fatalf("expected [1], got %v: %v", rest, err)
+	}
+	if d.More() {
+		t.Fatal("expected the stream to be fully consumed")
+	}
+
+	d = NewStreamDecoder([]byte("ut:l:i:1ei:2ee"))
+	if list, err = d.OpenList(); err != nil {
+		t.Fatal(err)
+	}
+	for n = 0; ; n++ {
+		if ok, err := list.Next(new(int)); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			break
+		}
+	}
+	if n != 2 || d.More() {
+		t.Fatalf("expected 2 elements and the list consumed, got %d", n)
+	}
+}
+
+func TestDecodeReader(t *testing.T) {
+	val := Product{
+		Name:        "Shirt",
+		Description: "black shirt",
+		Quantity:    5,
+		Image:       &ProductImage{Large: "large", Medium: "medium", Small: "small"},
+	}
+
+	data, err := Encode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one byte per Read, like a slow connection
+	res := Product{}
+	if err := DecodeReader(iotest.OneByteReader(bytes.NewReader(data)), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(val, res) {
+		t.Fatalf("expected %v, got %v", val, res)
+	}
+
+	stream := string(data) + "\nut:d:k1:ai:1ee\nut:l:s1:xe"
+	docs, err := NewReaderDecoder(iotest.OneByteReader(strings.NewReader(stream))).DecodeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 || !reflect.DeepEqual(docs[2], []interface{}{"x"}) {
+		t.Fatalf("unexpected %v", docs)
+	}
+
+	err = DecodeReader(iotest.OneByteReader(bytes.NewReader(data[:len(data)-1])), &res)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+
+	// the lengths aren't trusted to allocate the strings
+	for _, in := range []string{"ut:u4611686018427387904:abc", "ut:s100000:abc"} {
+		var s string
+		if err := DecodeReader(strings.NewReader(in), &s); err != io.ErrUnexpectedEOF {
+			t.Fatalf("%s: expected an unexpected EOF, got %v", in, err)
+		}
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+	d := NewStreamDecoder([]byte("ut:i:1e"), WithNumberKind(Number32))
+
+	var res interface{}
+	if err := d.DecodeNext(&res); err != nil || res != int32(1) {
+		t.Fatalf("expected 1, got %v: %v", res, err)
+	}
+	if d.More() {
+		t.Fatal("expected the stream to be over")
+	}
+
+	// the options are kept across resets
+	d.Reset([]byte("ut:i:2e\nut:i:3e"))
+	docs, err := d.DecodeAll()
+	if err != nil || !reflect.DeepEqual(docs, []interface{}{int32(2), int32(3)}) {
+		t.Fatalf("expected [2 3], got %v: %v", docs, err)
+	}
+
+	// a reader left in the middle of a document doesn't leak into the next
+	d.ResetReader(strings.NewReader("ut:l:i:4e"))
+	if err := d.DecodeNext(&res); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+
+	d.ResetReader(strings.NewReader("ut:i:5e"))
+	var n int
+	if err := d.DecodeNext(&n); err != nil || n != 5 {
+		t.Fatalf("expected 5, got %v: %v", n, err)
+	}
+}
+
+func BenchmarkPooledDecoder(b *testing.B) {
+	data, err := Encode(Product{Name: "pan", Quantity: 3})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pool := sync.Pool{New: func() interface{} { return NewDecoder() }}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		d := pool.Get().(*Decoder)
+		d.Reset(data)
+
+		var res Product
+		if err := d.DecodeNext(&res); err != nil {
+			b.Fatal(err)
+		}
+		pool.Put(d)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	vals := []Product{
+		{Name: "pan", Quantity: 3},
+		{Name: "hat", Image: &ProductImage{Small: "s"}},
+		{},
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		for _, val := range vals {
+			if err := WriteFrame(w, val); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.Close()
+	}()
+
+	for _, val := range vals {
+		res := Product{}
+		if err := ReadFrame(r, &res); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, val) {
+			t.Fatalf("expected %v, got %v", val, res)
+		}
+	}
+	if err := ReadFrame(r, &Product{}); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last frame, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, 42); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "\x00\x00\x00\x08ut:i:42e" {
+		t.Fatalf("unexpected frame %q", buf.String())
+	}
+
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+	if err := ReadFrame(truncated, new(int)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+
+	// a corrupt length isn't allocated before the document is read
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	hostile := strings.NewReader("\xff\xff\xff\xffut:i:42e")
+	if err := ReadFrame(hostile, new(int)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if after.TotalAlloc-before.TotalAlloc > 1<<20 {
+		t.Fatalf("expected bounded memory, %d bytes were allocated", after.TotalAlloc-before.TotalAlloc)
+	}
+}
@@ -1,5 +1,70 @@
 package utcode
 
+import (
+	"reflect"
+	"strings"
+)
+
 var (
 	TagName = "utcode"
 )
+
+// tagOptions is the comma-separated list of options following
+// the name in a struct tag, e.g. "ascii" in `utcode:"code,ascii"`
+type tagOptions string
+
+// Contains reports whether the option is present in the list
+func (o tagOptions) Contains(option string) bool {
+	if o == "" {
+		return false
+	}
+
+	for _, opt := range strings.Split(string(o), ",") {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns the value of an option given as name=value, e.g. the
+// "1" of "default=1". The value can't hold a comma.
+func (o tagOptions) Value(name string) (string, bool) {
+	if o == "" {
+		return "", false
+	}
+
+	for _, opt := range strings.Split(string(o), ",") {
+		if strings.HasPrefix(opt, name+"=") {
+			return opt[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// fieldName returns the wire name of the struct field along with its tag
+// options. Without a name in the tag, the field name with its first letter
+// lowercased is used.
+func fieldName(field reflect.StructField) (string, tagOptions) {
+	name, opts := field.Tag.Get(TagName), ""
+	if i := strings.IndexByte(name, ','); i >= 0 {
+		name, opts = name[:i], name[i+1:]
+	}
+
+	if name == "" {
+		name = strings.ToLower(field.Name[:1]) + field.Name[1:]
+	}
+	return name, tagOptions(opts)
+}
+
+// hasTagName reports whether the wire name of the field comes from its tag
+func hasTagName(field reflect.StructField) bool {
+	tag := field.Tag.Get(TagName)
+	return tag != "" && tag[0] != ','
+}
+
+// isTagged reports whether the field has a tag, even one holding only options
+func isTagged(field reflect.StructField) bool {
+	_, ok := field.Tag.Lookup(TagName)
+	return ok
+}
@@ -0,0 +1,377 @@
+package utcode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// TokenKind is the kind of a Token
+type TokenKind int
+
+const (
+	// HeaderToken is the "ut:" header starting every document
+	HeaderToken TokenKind = iota
+	// NilValue is a nil value
+	NilValue
+	// BoolValue is a bool value, held as a bool
+	BoolValue
+	// IntValue is an int value, held as an int64
+	IntValue
+	// FloatValue is a float value, held as a float64
+	FloatValue
+	// StringValue is a raw string value, held as a string
+	StringValue
+	// UnicodeValue is a base64 encoded string value, held decoded as a string
+	UnicodeValue
+	// KeyToken is a dict key, held as a string
+	KeyToken
+	// DictStart starts a dict, its keys and values follow
+	DictStart
+	// DictEnd ends a dict
+	DictEnd
+	// ListStart starts a list, its values follow
+	ListStart
+	// ListEnd ends a list
+	ListEnd
+	// CustomStart starts a custom value, holding its type key (e.g. "cx")
+	CustomStart
+	// CustomEnd ends a custom value
+	CustomEnd
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case HeaderToken:
+		return "header"
+	case NilValue:
+		return "nil"
+	case BoolValue:
+		return "bool"
+	case IntValue:
+		return "int"
+	case FloatValue:
+		return "float"
+	case StringValue:
+		return "string"
+	case UnicodeValue:
+		return "unicode"
+	case KeyToken:
+		return "key"
+	case DictStart:
+		return "dict start"
+	case DictEnd:
+		return "dict end"
+	case ListStart:
+		return "list start"
+	case ListEnd:
+		return "list end"
+	case CustomStart:
+		return "custom start"
+	case CustomEnd:
+		return "custom end"
+	default:
+		return "unknown"
+	}
+}
+
+// Token is a syntactic element of a document, see Tokenizer
+type Token struct {
+	Kind   TokenKind
+	Offset int         // offset of the token in the input
+	Value  interface{} // the value of scalars and keys, the type key of a CustomStart
+}
+
+// Tokenizer splits UTCode input into tokens, without any knowledge of the
+// Go types it may be decoded into. It's meant for tooling like linters and
+// converters. Custom values are tokenized assuming their payload is made of
+// regular values terminated by 'e', as the built-in types do.
+type Tokenizer struct {
+	// NoHeader expects the documents without the "ut:" header
+	NoHeader bool
+
+	// Base64Encoding is the alphabet of the unicode strings, see
+	// Decoder.Base64Encoding
+	Base64Encoding *base64.Encoding
+
+	r      *bufio.Reader
+	off    int
+	inDoc  bool
+	frames []tokenFrame
+
+	// captured holds the bytes read while capture is set
+	captured []byte
+	capture  bool
+}
+
+// tokenFrame is an open dict, list or custom value
+type tokenFrame struct {
+	kind    TokenKind
+	keyNext bool
+}
+
+// NewTokenizer returns a Tokenizer reading from r, which may hold a stream
+// of documents optionally separated by newlines
+func NewTokenizer(r io.Reader) *Tokenizer {
+	return &Tokenizer{r: bufio.NewReader(r)}
+}
+
+// Next returns the next token, or io.EOF when the input ends
+// between documents
+func (t *Tokenizer) Next() (Token, error) {
+	if !t.inDoc {
+		if err := t.skipSeparators(); err != nil {
+			return Token{}, err
+		}
+
+		t.inDoc = true
+		if !t.NoHeader {
+			off := t.off
+			if header, err := t.read(3); err != nil || string(header) != "ut:" {
+				return Token{}, NewDecodeError("invalid utcode")
+			}
+			return Token{Kind: HeaderToken, Offset: off}, nil
+		}
+	}
+
+	off := t.off
+	if n := len(t.frames); n > 0 {
+		frame := &t.frames[n-1]
+
+		b, err := t.r.Peek(1)
+		if err != nil {
+			return Token{}, t.unexpected(err)
+		}
+
+		if b[0] == 'e' {
+			kind := endKind(frame.kind)
+			t.read(1)
+			t.frames = t.frames[:n-1]
+			t.valueDone()
+			return Token{Kind: kind, Offset: off}, nil
+		}
+
+		if frame.kind == DictStart && frame.keyNext {
+			key, err := t.readKey()
+			if err != nil {
+				return Token{}, err
+			}
+			frame.keyNext = false
+			return Token{Kind: KeyToken, Offset: off, Value: key}, nil
+		}
+	}
+
+	key, err := t.readUntil(':')
+	if err != nil {
+		return Token{}, err
+	}
+
+	tok := Token{Offset: off}
+	switch key[0] {
+	case 'n':
+		tok.Kind = NilValue
+		_, err = t.read(1)
+	case 'b':
+		var b []byte
+		if b, err = t.read(1); err == nil {
+			var val bool
+			if val, err = parseBool(b[0]); err == nil {
+				tok.Kind, tok.Value = BoolValue, val
+			}
+		}
+	case 'i':
+		var str string
+		if str, err = t.readUntil('e'); err == nil {
+			var i int64
+			// the grammar is the one of parseInt
+			if i, err = strconv.ParseInt(str, 10, 64); err == nil {
+				tok.Kind, tok.Value = IntValue, i
+			} else {
+				err = wrapDecodeError("invalid int", err)
+			}
+		}
+	case 'f':
+		var str string
+		if str, err = t.readUntil('z'); err == nil {
+			var f float64
+			if f, err = strconv.ParseFloat(str, 64); err == nil {
+				tok.Kind, tok.Value = FloatValue, f
+			} else {
+				err = wrapDecodeError("invalid float", err)
+			}
+		}
+	case 's', 'u':
+		var str string
+		if str, err = t.readString(key); err == nil {
+			tok.Kind, tok.Value = StringValue, str
+			if key[0] == 'u' {
+				var data []byte
+				if data, err = base64Encoding(t.Base64Encoding, len(str)).DecodeString(str); err == nil {
+					tok.Kind, tok.Value = UnicodeValue, string(data)
+				} else {
+					err = wrapDecodeError("invalid unicode string", err)
+				}
+			}
+		}
+	case 'd':
+		tok.Kind = DictStart
+		t.frames = append(t.frames, tokenFrame{kind: DictStart, keyNext: true})
+		return tok, nil
+	case 'l':
+		tok.Kind = ListStart
+		t.frames = append(t.frames, tokenFrame{kind: ListStart})
+		return tok, nil
+	case 'c':
+		if len(key) < 2 {
+			return Token{}, NewDecodeError("missing custom type code")
+		}
+		tok.Kind, tok.Value = CustomStart, key
+		t.frames = append(t.frames, tokenFrame{kind: CustomStart})
+		return tok, nil
+	default:
+		return Token{}, NewDecodeError(fmt.Sprintf("invalid utcode type '%c'", key[0]))
+	}
+
+	if err != nil {
+		return Token{}, err
+	}
+
+	t.valueDone()
+	return tok, nil
+}
+
+// valueDone moves past a complete value, ending the document when
+// it's the top-level one
+func (t *Tokenizer) valueDone() {
+	n := len(t.frames)
+	if n == 0 {
+		t.inDoc = false
+	} else if t.frames[n-1].kind == DictStart {
+		t.frames[n-1].keyNext = true
+	}
+}
+
+func endKind(start TokenKind) TokenKind {
+	switch start {
+	case DictStart:
+		return DictEnd
+	case ListStart:
+		return ListEnd
+	default:
+		return CustomEnd
+	}
+}
+
+// skipOpened reads up to the end of the value started by tok
+func (t *Tokenizer) skipOpened(tok Token) error {
+	switch tok.Kind {
+	case DictStart, ListStart, CustomStart:
+	default:
+		return nil
+	}
+
+	for depth := len(t.frames); len(t.frames) >= depth; {
+		if _, err := t.Next(); err != nil {
+			return t.unexpected(err)
+		}
+	}
+	return nil
+}
+
+func (t *Tokenizer) skipSeparators() error {
+	for {
+		b, err := t.r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != '\n' && b[0] != '\r' {
+			return nil
+		}
+		t.read(1)
+	}
+}
+
+func (t *Tokenizer) readKey() (string, error) {
+	key, err := t.readUntil(':')
+	if err != nil {
+		return "", err
+	}
+
+	if key[0] != 'k' {
+		return "", NewDecodeError("invalid dict key")
+	}
+	return t.readString(key)
+}
+
+// readString reads the string whose length follows the type code of key
+func (t *Tokenizer) readString(key string) (string, error) {
+	length, err := parseInt(key[1:])
+	if err != nil {
+		return "", err
+	}
+
+	data, err := t.read(length)
+	return string(data), err
+}
+
+func (t *Tokenizer) read(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, NewDecodeError("invalid length")
+	}
+
+	var data []byte
+	var err error
+	if n <= maxPrealloc {
+		data = make([]byte, n)
+		var read int
+		read, err = io.ReadFull(t.r, data)
+		data = data[:read]
+	} else {
+		// the length comes from the input, so the data is read in chunks
+		// rather than allocated upfront, a short input failing at its end
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, t.r, int64(n))
+		data = buf.Bytes()
+	}
+
+	t.off += len(data)
+	if t.capture {
+		t.captured = append(t.captured, data...)
+	}
+	if err != nil {
+		return nil, t.unexpected(err)
+	}
+	return data, nil
+}
+
+// maxPrealloc is the largest length read by the Tokenizer into a buffer
+// allocated upfront
+const maxPrealloc = 64 << 10
+
+// readUntil reads up to ch, which is consumed but not returned
+func (t *Tokenizer) readUntil(ch byte) (string, error) {
+	str, err := t.r.ReadString(ch)
+	t.off += len(str)
+	if t.capture {
+		t.captured = append(t.captured, str...)
+	}
+	if err != nil {
+		return "", t.unexpected(err)
+	}
+
+	if len(str) == 1 {
+		return "", NewDecodeError(fmt.Sprintf("empty token before '%c'", ch))
+	}
+	return str[:len(str)-1], nil
+}
+
+// unexpected turns an io.EOF in the middle of a document into io.ErrUnexpectedEOF
+func (t *Tokenizer) unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package utcode
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizer(t *testing.T) {
+	input := "ut:d:k4:namei:-12ek4:tagsl:b:1n:ef:0.5zs3:abcek1:cu4:w6k=k1:xcp:i:1ei:2eee\nut:i:7e"
+
+	var tokens []Token
+	tz := NewTokenizer(strings.NewReader(input))
+	for {
+		tok, err := tz.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tok)
+	}
+
+	expected := []Token{
+		{HeaderToken, 0, nil},
+		{DictStart, 3, nil},
+		{KeyToken, 5, "name"},
+		{IntValue, 12, int64(-12)},
+		{KeyToken, 18, "tags"},
+		{ListStart, 25, nil},
+		{BoolValue, 27, true},
+		{NilValue, 30, nil},
+		{FloatValue, 33, 0.5},
+		{StringValue, 39, "abc"},
+		{ListEnd, 45, nil},
+		{KeyToken, 46, "c"},
+		{UnicodeValue, 50, "é"},
+		{KeyToken, 57, "x"},
+		{CustomStart, 61, "cp"},
+		{IntValue, 64, int64(1)},
+		{IntValue, 68, int64(2)},
+		{CustomEnd, 72, nil},
+		{DictEnd, 73, nil},
+		{HeaderToken, 75, nil},
+		{IntValue, 78, int64(7)},
+	}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("expected %v, got %v", expected, tokens)
+	}
+
+	tz = NewTokenizer(strings.NewReader("ut:l:i:1e"))
+	for i := 0; i < 3; i++ {
+		tz.Next()
+	}
+	if _, err := tz.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+}
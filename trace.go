@@ -0,0 +1,40 @@
+package utcode
+
+// TraceKind is the kind of token reported by a TraceEvent
+type TraceKind int
+
+const (
+	// TraceValue is reported when a value starts, along with its wire type
+	TraceValue TraceKind = iota
+	// TraceKey is reported for every dict key
+	TraceKey
+	// TraceEnd is reported when a dict or a list ends
+	TraceEnd
+)
+
+func (k TraceKind) String() string {
+	switch k {
+	case TraceValue:
+		return "value"
+	case TraceKey:
+		return "key"
+	case TraceEnd:
+		return "end"
+	default:
+		return "unknown"
+	}
+}
+
+// TraceEvent describes a token read by the Decoder, see Decoder.Trace
+type TraceEvent struct {
+	Kind   TraceKind
+	Offset int    // offset of the token in the data
+	Type   byte   // wire type code of a TraceValue
+	Key    string // the key of a TraceKey
+}
+
+func (d *Decoder) trace(kind TraceKind, off int, typ byte, key string) {
+	if d.Trace != nil {
+		d.Trace(TraceEvent{Kind: kind, Offset: off, Type: typ, Key: key})
+	}
+}
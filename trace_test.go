@@ -0,0 +1,35 @@
+package utcode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeTrace(t *testing.T) {
+	var events []TraceEvent
+
+	d := NewDecoder()
+	d.Trace = func(event TraceEvent) {
+		events = append(events, event)
+	}
+
+	res := map[string]interface{}{}
+	if err := d.Decode([]byte("ut:d:k1:al:i:1eb:1ek1:bn:ee"), res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TraceEvent{
+		{Kind: TraceValue, Offset: 3, Type: 'd'},
+		{Kind: TraceKey, Offset: 5, Key: "a"},
+		{Kind: TraceValue, Offset: 9, Type: 'l'},
+		{Kind: TraceValue, Offset: 11, Type: 'i'},
+		{Kind: TraceValue, Offset: 15, Type: 'b'},
+		{Kind: TraceEnd, Offset: 18},
+		{Kind: TraceKey, Offset: 19, Key: "b"},
+		{Kind: TraceValue, Offset: 23, Type: 'n'},
+		{Kind: TraceEnd, Offset: 26},
+	}
+	if !reflect.DeepEqual(expected, events) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+}